@@ -0,0 +1,120 @@
+package caddy_docker_upstreams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI serves the candidates discovered by the docker upstreams on the
+// admin endpoint, e.g. `curl localhost:2019/docker_upstreams/`.
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.docker_upstreams",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes of the docker upstreams.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/docker_upstreams/",
+			Handler: caddy.AdminHandlerFunc(a.handleUpstreams),
+		},
+		{
+			Pattern: "/docker_upstreams/groups",
+			Handler: caddy.AdminHandlerFunc(a.handleGroups),
+		},
+	}
+}
+
+type adminUpstream struct {
+	Instance  string            `json:"instance,omitempty"`
+	Endpoint  string            `json:"endpoint"`
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Dial      string            `json:"dial"`
+	Address   string            `json:"address"`
+	Confirmed time.Time         `json:"confirmed"`
+	Health    string            `json:"health,omitempty"`
+	Group     string            `json:"group,omitempty"`
+	TLS       map[string]string `json:"tls,omitempty"`
+	Weight    int               `json:"weight"`
+	Matchers  map[string]string `json:"matchers"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type adminUpstreams struct {
+	Refreshed time.Time       `json:"refreshed"`
+	Upstreams []adminUpstream `json:"upstreams"`
+}
+
+// handleUpstreams writes the current candidates of every instance as JSON.
+func (a *adminAPI) handleUpstreams(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	var refreshed time.Time
+	var candidates []candidate
+	for _, s := range loadSnapshots() {
+		if s.refreshed.After(refreshed) {
+			refreshed = s.refreshed
+		}
+		candidates = append(candidates, s.candidates...)
+	}
+	out := newAdminUpstreams(refreshed, candidates)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(out)
+}
+
+func newAdminUpstreams(refreshed time.Time, candidates []candidate) adminUpstreams {
+	out := adminUpstreams{
+		Refreshed: refreshed,
+		Upstreams: make([]adminUpstream, 0, len(candidates)),
+	}
+	for _, c := range candidates {
+		matchers := make(map[string]string)
+		for key, value := range c.labels {
+			if isMatcherLabel(key) {
+				matchers[key] = value
+			}
+		}
+
+		out.Upstreams = append(out.Upstreams, adminUpstream{
+			Instance:  c.instance,
+			Endpoint:  c.endpoint,
+			ID:        c.id,
+			Name:      c.name,
+			Dial:      c.upstream.Dial,
+			Address:   c.address,
+			Confirmed: c.confirmed,
+			Health:    c.health,
+			Group:     c.deployGroup,
+			TLS:       c.tls,
+			Weight:    c.weight,
+			Matchers:  matchers,
+			Labels:    c.labels,
+		})
+	}
+	return out
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
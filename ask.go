@@ -0,0 +1,75 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Ask{})
+	httpcaddyfile.RegisterHandlerDirective("docker_ask", parseAskCaddyfile)
+}
+
+// Ask answers the `ask` requests of on-demand TLS, the domain is allowed if
+// it matches the host matcher label of a container.
+type Ask struct{}
+
+func (Ask) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.docker_ask",
+		New: func() caddy.Module { return new(Ask) },
+	}
+}
+
+// ServeHTTP responds 200 if the domain query parameter is the host of a
+// container, 404 otherwise.
+func (a *Ask) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+
+	if !deployedHost(domain) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// deployedHost reports whether the host matcher label of a candidate of any
+// instance matches the domain. The candidates without host label don't allow
+// any domain.
+func deployedHost(domain string) bool {
+	return len(LookupHost(domain)) > 0
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into a.
+//
+//	docker_ask
+func (a *Ask) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+func parseAskCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	a := new(Ask)
+	err := a.UnmarshalCaddyfile(h.Dispenser)
+	return a, err
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*Ask)(nil)
+	_ caddyfile.Unmarshaler       = (*Ask)(nil)
+)
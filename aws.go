@@ -0,0 +1,296 @@
+package caddy_docker_upstreams
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	awsContainerCredentialsHost = "http://169.254.170.2"
+	awsInstanceMetadataHost     = "http://169.254.169.254"
+
+	// awsCredentialsExpiryWindow is how long before their expiration the
+	// temporary credentials are renewed.
+	awsCredentialsExpiryWindow = 5 * time.Minute
+)
+
+// awsCredentials are the credentials signing the AWS API requests.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsClient sends JSON requests signed with signature version 4 to an AWS
+// service. The credentials are read from the AWS_* environment variables, or
+// from the container credentials of the ECS task, or from the instance
+// profile of the EC2 instance.
+type awsClient struct {
+	service string
+	region  string
+	http    *http.Client
+
+	mu          sync.Mutex
+	credentials *awsCredentials
+}
+
+// do sends the JSON request of the target action and decodes the response
+// into v.
+func (c *awsClient) do(ctx context.Context, target string, in, v any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	creds, err := c.getCredentials(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get aws credentials: %w", err)
+	}
+
+	host := c.service + "." + c.region + ".amazonaws.com"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signAWSRequest(req, body, creds, c.service, c.region, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", target, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// signAWSRequest adds the signature version 4 of the request, signing the
+// host and the other headers of the request.
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, service, region string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	// The headers are sorted by name, with their values trimmed and their
+	// sequential spaces collapsed.
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "host" || name == "authorization" {
+			continue
+		}
+		trimmed := make([]string, 0, len(values))
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[name] = strings.Join(trimmed, ",")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// awsCanonicalQuery returns the query sorted by key and value, with the
+// characters other than the unreserved ones percent-encoded.
+func awsCanonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func awsEscape(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.ReplaceAll(s, "+", "%20")
+	return strings.ReplaceAll(s, "%7E", "~")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// getCredentials returns the credentials, renewed if they are expiring.
+func (c *awsClient) getCredentials(ctx context.Context) (*awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credentials != nil && (c.credentials.Expiration.IsZero() || time.Until(c.credentials.Expiration) > awsCredentialsExpiryWindow) {
+		return c.credentials, nil
+	}
+
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		c.credentials = &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, Token: os.Getenv("AWS_SESSION_TOKEN")}
+		return c.credentials, nil
+	}
+
+	var creds awsCredentials
+	var err error
+	switch {
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "":
+		err = c.getJSON(ctx, awsContainerCredentialsHost+os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"), nil, &creds)
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		header := http.Header{}
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			header.Set("Authorization", token)
+		}
+		err = c.getJSON(ctx, os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"), header, &creds)
+	default:
+		err = c.instanceCredentials(ctx, &creds)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" {
+		return nil, errors.New("no credentials found")
+	}
+
+	c.credentials = &creds
+	return c.credentials, nil
+}
+
+// instanceCredentials reads the credentials of the instance profile with
+// IMDSv2.
+func (c *awsClient) instanceCredentials(ctx context.Context, creds *awsCredentials) error {
+	header, err := c.instanceMetadataHeader(ctx)
+	if err != nil {
+		return err
+	}
+
+	url := awsInstanceMetadataHost + "/latest/meta-data/iam/security-credentials/"
+	role, err := c.getText(ctx, url, header)
+	if err != nil {
+		return err
+	}
+	role, _, _ = strings.Cut(strings.TrimSpace(role), "\n")
+
+	return c.getJSON(ctx, url+role, header, creds)
+}
+
+// instanceRegion returns the region of the EC2 instance.
+func (c *awsClient) instanceRegion(ctx context.Context) (string, error) {
+	header, err := c.instanceMetadataHeader(ctx)
+	if err != nil {
+		return "", err
+	}
+	region, err := c.getText(ctx, awsInstanceMetadataHost+"/latest/meta-data/placement/region", header)
+	return strings.TrimSpace(region), err
+}
+
+// instanceMetadataHeader returns the header authorizing the instance
+// metadata requests.
+func (c *awsClient) instanceMetadataHeader(ctx context.Context) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsInstanceMetadataHost+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+
+	token, err := c.send(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get instance metadata token: %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("X-Aws-Ec2-Metadata-Token", token)
+	return header, nil
+}
+
+func (c *awsClient) getJSON(ctx context.Context, url string, header http.Header, v any) error {
+	text, err := c.getText(ctx, url, header)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(text), v)
+}
+
+func (c *awsClient) getText(ctx context.Context, url string, header http.Header) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	return c.send(req)
+}
+
+func (c *awsClient) send(req *http.Request) (string, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", req.URL.Path, resp.Status)
+	}
+	return string(body), nil
+}
@@ -0,0 +1,56 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The vectors are the get-vanilla case of the AWS signature version 4 test
+// suite and the IAM ListUsers example of the AWS documentation.
+func TestSignAWSRequest(t *testing.T) {
+	creds := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		url           string
+		header        http.Header
+		service       string
+		authorization string
+	}{
+		{
+			name:    "get-vanilla",
+			url:     "https://example.amazonaws.com/",
+			service: "service",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:    "iam-list-users",
+			url:     "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+			header:  http.Header{"Content-Type": {"application/x-www-form-urlencoded; charset=utf-8"}},
+			service: "iam",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range tt.header {
+			req.Header[name] = values
+		}
+
+		signAWSRequest(req, nil, creds, tt.service, "us-east-1", now)
+		if got := req.Header.Get("Authorization"); got != tt.authorization {
+			t.Errorf("%s: Authorization = %q, want %q", tt.name, got, tt.authorization)
+		}
+	}
+}
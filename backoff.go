@@ -0,0 +1,73 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	reconnectMinDelay        = 500 * time.Millisecond
+	defaultReconnectMaxDelay = 30 * time.Second
+
+	// streamDownThreshold is how long the event stream may be down before
+	// it is reported as an error.
+	streamDownThreshold = time.Minute
+)
+
+// waitDaemon waits until the daemon of the endpoint answers again, retrying
+// with an exponential backoff and jitter. It returns false if ctx is done.
+func (u *Upstreams) waitDaemon(ctx context.Context, e *endpoint) bool {
+	metrics.streamUp.WithLabelValues(e.name).Set(0)
+	setStreamDown(u.Instance, e.name, true)
+
+	down := time.Now()
+	delay := reconnectMinDelay
+	reported := false
+	stale := u.checkStale(e, false)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(jitter(delay)):
+		}
+
+		err := e.ping(ctx)
+		if err == nil {
+			metrics.streamUp.WithLabelValues(e.name).Set(1)
+			metrics.stale.WithLabelValues(e.name).Set(0)
+			setStreamDown(u.Instance, e.name, false)
+			if reported {
+				u.logger.Info("event stream is back",
+					zap.String("endpoint", e.name),
+					zap.Duration("downtime", time.Since(down)),
+				)
+			}
+			return true
+		}
+
+		if !reported && time.Since(down) >= streamDownThreshold {
+			u.logger.Error("event stream is down",
+				zap.String("endpoint", e.name),
+				zap.Duration("downtime", time.Since(down)),
+				zap.Error(err),
+			)
+			reported = true
+		}
+		stale = u.checkStale(e, stale)
+
+		delay *= 2
+		if max := time.Duration(u.ReconnectMaxDelay); delay > max {
+			delay = max
+		}
+	}
+}
+
+// jitter returns a random duration between d/2 and d, so the instances
+// connected to the same daemon don't reconnect at once.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -1,18 +1,466 @@
 package caddy_docker_upstreams
 
-import "github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
 
 // UnmarshalCaddyfile deserializes Caddyfile tokens into u.
 //
-//	dynamic docker
+//	dynamic docker {
+//		host                   <address>
+//		api_version            <version>
+//		cert_path              <path>
+//		tls_verify
+//		tls_ca                 <path|pem>
+//		tls_cert               <path|pem>
+//		tls_key                <path|pem>
+//		provider               docker|podman|nomad|kubernetes|containerd
+//		provider               <module> [{ ... }]
+//		mode                   container|swarm|poll
+//		poll_interval          <duration>
+//		default_network        <name>
+//		caddy_networks
+//		host_gateway           <address>
+//		webhook                <url>
+//		emit_events
+//		fallback               <address>
+//		health_check
+//		startup_delay          <duration>
+//		probe_interval         <duration>
+//		probe_failures         <n>
+//		crash_loop_restarts    <n>
+//		crash_loop_backoff     <duration>
+//		tolerate_restarts      <duration>
+//		debounce               <duration>
+//		resync_interval        <duration>
+//		reconnect_max_delay    <duration>
+//		api_timeout            <duration>
+//		api_rate_limit         <rps>
+//		disable_api            ping|events...
+//		max_staleness          <duration>
+//		stale_policy           serve|fail
+//		lazy_connect
+//		auto_detect_port
+//		port_preference        <port...>
+//		use_published_ports
+//		ip_version             prefer_ipv4|prefer_ipv6|ipv4_only|ipv6_only
+//		dial_name              container|service
+//		swarm_dial             tasks|vip
+//		address_template       <template>
+//		group_compose_services
+//		recreate_timeout       <duration>
+//		wait_dependencies
+//		filter_compose_project <project...>
+//		filter_label           <label...>
+//		include_name           <glob...>
+//		include_image          <glob...>
+//		exclude_name           <glob...>
+//		exclude_image          <glob...>
+//		label_prefix           <prefix>
+//		instance               <name>
+//		traefik
+//		env_labels
+//		strict_labels
+//		endpoint [<name>] {
+//			host        <address>
+//			api_version <version>
+//			cert_path   <path>
+//			tls_verify
+//			tls_ca      <path|pem>
+//			tls_cert    <path|pem>
+//			tls_key     <path|pem>
+//		}
+//	}
 func (u *Upstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		if d.NextArg() {
 			return d.ArgErr()
 		}
-		if d.NextBlock(0) {
-			return d.Errf("unrecognized docker option '%s'", d.Val())
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "host", "api_version", "cert_path", "tls_verify", "tls_ca", "tls_cert", "tls_key":
+				config := Endpoint{
+					Host:       u.Host,
+					APIVersion: u.APIVersion,
+					CertPath:   u.CertPath,
+					TLSVerify:  u.TLSVerify,
+					TLSCA:      u.TLSCA,
+					TLSCert:    u.TLSCert,
+					TLSKey:     u.TLSKey,
+				}
+				err := unmarshalEndpointOption(d, &config)
+				if err != nil {
+					return err
+				}
+				u.Host = config.Host
+				u.APIVersion = config.APIVersion
+				u.CertPath = config.CertPath
+				u.TLSVerify = config.TLSVerify
+				u.TLSCA = config.TLSCA
+				u.TLSCert = config.TLSCert
+				u.TLSKey = config.TLSKey
+			case "endpoint":
+				var config Endpoint
+				if d.NextArg() {
+					config.Name = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					err := unmarshalEndpointOption(d, &config)
+					if err != nil {
+						return err
+					}
+				}
+				u.Endpoints = append(u.Endpoints, config)
+			case "provider":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch name := d.Val(); name {
+				case ProviderDocker, ProviderPodman, ProviderNomad, ProviderKubernetes, ProviderContainerd:
+					u.Provider = name
+				default:
+					unm, err := caddyfile.UnmarshalModule(d, providersNamespace+"."+name)
+					if err != nil {
+						return err
+					}
+					u.ProvidersRaw = append(u.ProvidersRaw, caddyconfig.JSONModuleObject(unm, "provider", name, nil))
+				}
+			case "mode":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.Mode = d.Val()
+			case "poll_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad poll_interval value '%s': %v", d.Val(), err)
+				}
+				u.PollInterval = caddy.Duration(dur)
+			case "default_network":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.DefaultNetwork = d.Val()
+			case "caddy_networks":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.CaddyNetworks = true
+			case "host_gateway":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.HostGateway = d.Val()
+			case "webhook":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.Webhook = d.Val()
+			case "emit_events":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.EmitEvents = true
+			case "fallback":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.Fallback = d.Val()
+			case "health_check":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.HealthCheck = true
+			case "startup_delay":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad startup_delay value '%s': %v", d.Val(), err)
+				}
+				u.StartupDelay = caddy.Duration(dur)
+			case "probe_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad probe_interval value '%s': %v", d.Val(), err)
+				}
+				u.ProbeInterval = caddy.Duration(dur)
+			case "probe_failures":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil || n < 1 {
+					return d.Errf("bad probe_failures value '%s'", d.Val())
+				}
+				u.ProbeFailures = n
+			case "crash_loop_restarts":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil || n < 1 {
+					return d.Errf("bad crash_loop_restarts value '%s'", d.Val())
+				}
+				u.CrashLoopRestarts = n
+			case "crash_loop_backoff":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad crash_loop_backoff value '%s': %v", d.Val(), err)
+				}
+				u.CrashLoopBackoff = caddy.Duration(dur)
+			case "tolerate_restarts":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad tolerate_restarts value '%s': %v", d.Val(), err)
+				}
+				u.TolerateRestarts = caddy.Duration(dur)
+			case "debounce":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad debounce value '%s': %v", d.Val(), err)
+				}
+				u.Debounce = caddy.Duration(dur)
+			case "resync_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad resync_interval value '%s': %v", d.Val(), err)
+				}
+				u.ResyncInterval = caddy.Duration(dur)
+			case "reconnect_max_delay":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad reconnect_max_delay value '%s': %v", d.Val(), err)
+				}
+				u.ReconnectMaxDelay = caddy.Duration(dur)
+			case "api_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad api_timeout value '%s': %v", d.Val(), err)
+				}
+				u.APITimeout = caddy.Duration(dur)
+			case "api_rate_limit":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rps, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil || rps <= 0 {
+					return d.Errf("bad api_rate_limit value '%s'", d.Val())
+				}
+				u.APIRateLimit = rps
+			case "disable_api":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				u.DisableAPI = append(u.DisableAPI, args...)
+			case "max_staleness":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad max_staleness value '%s': %v", d.Val(), err)
+				}
+				u.MaxStaleness = caddy.Duration(dur)
+			case "stale_policy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.StalePolicy = d.Val()
+			case "lazy_connect":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.LazyConnect = true
+			case "auto_detect_port":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.AutoDetectPort = true
+			case "port_preference":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				u.PortPreference = append(u.PortPreference, args...)
+			case "use_published_ports":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.UsePublishedPorts = true
+			case "ip_version":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.IPVersion = d.Val()
+			case "dial_name":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.DialName = d.Val()
+			case "swarm_dial":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.SwarmDial = d.Val()
+			case "address_template":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.AddressTemplate = d.Val()
+			case "group_compose_services":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.GroupComposeServices = true
+			case "recreate_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad recreate_timeout value '%s': %v", d.Val(), err)
+				}
+				u.RecreateTimeout = caddy.Duration(dur)
+			case "wait_dependencies":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.WaitDependencies = true
+			case "filter_compose_project":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				u.FilterComposeProject = append(u.FilterComposeProject, args...)
+			case "filter_label":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				u.FilterLabel = append(u.FilterLabel, args...)
+			case "include_name", "include_image", "exclude_name", "exclude_image":
+				option := d.Val()
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				switch option {
+				case "include_name":
+					u.IncludeName = append(u.IncludeName, args...)
+				case "include_image":
+					u.IncludeImage = append(u.IncludeImage, args...)
+				case "exclude_name":
+					u.ExcludeName = append(u.ExcludeName, args...)
+				case "exclude_image":
+					u.ExcludeImage = append(u.ExcludeImage, args...)
+				}
+			case "label_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.LabelPrefix = d.Val()
+			case "instance":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.Instance = d.Val()
+			case "traefik":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.Traefik = true
+			case "env_labels":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.EnvLabels = true
+			case "strict_labels":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.StrictLabels = true
+			default:
+				return d.Errf("unrecognized docker option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func unmarshalEndpointOption(d *caddyfile.Dispenser, config *Endpoint) error {
+	switch d.Val() {
+	case "host":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		config.Host = d.Val()
+	case "api_version":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		config.APIVersion = d.Val()
+	case "cert_path":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		config.CertPath = d.Val()
+	case "tls_verify":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		config.TLSVerify = true
+	case "tls_ca":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		config.TLSCA = d.Val()
+	case "tls_cert":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		config.TLSCert = d.Val()
+	case "tls_key":
+		if !d.NextArg() {
+			return d.ArgErr()
 		}
+		config.TLSKey = d.Val()
+	default:
+		return d.Errf("unrecognized endpoint option '%s'", d.Val())
 	}
 	return nil
 }
@@ -0,0 +1,63 @@
+package caddy_docker_upstreams
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const LabelCanaryHeader = "com.caddyserver.http.canary.header"
+
+// canaryPriority is the priority of the canary containers, which takes
+// precedence over the default priority of the other containers.
+const canaryPriority = -1
+
+// parseCanaryHeader parses the value of the canary.header label, either
+// `<field>:<value>`, `<field>=<value>` or `<field>` to only require the
+// header, in which case headerValue is `*`.
+func parseCanaryHeader(value string) (field, headerValue string, err error) {
+	field, headerValue = value, ""
+	if i := strings.IndexAny(value, ":="); i >= 0 {
+		field, headerValue = value[:i], value[i+1:]
+	}
+	field, headerValue = strings.TrimSpace(field), strings.TrimSpace(headerValue)
+	if field == "" || strings.ContainsAny(field, " .") {
+		return "", "", errors.New("invalid header field")
+	}
+	if headerValue == "" {
+		// An empty value would only match an empty header.
+		headerValue = "*"
+	}
+	return field, headerValue, nil
+}
+
+// canaryLabels expands the canary.header label into a header matcher label,
+// and a priority label unless it is set, so the requests having the header
+// go to the canary instead of the other containers matching them.
+func (u *Upstreams) canaryLabels(labels map[string]string, fields ...zap.Field) map[string]string {
+	value, ok := labels[LabelCanaryHeader]
+	if !ok {
+		return labels
+	}
+
+	field, headerValue, err := parseCanaryHeader(value)
+	if err != nil {
+		u.logger.Error("invalid canary header label", append(fields,
+			zap.String("value", value),
+			zap.Error(err),
+		)...)
+		return labels
+	}
+
+	expanded := make(map[string]string, len(labels)+2)
+	for key, value := range labels {
+		expanded[key] = value
+	}
+	expanded[LabelMatchHeaderPrefix+field] = headerValue
+	if _, ok := expanded[LabelUpstreamPriority]; !ok {
+		expanded[LabelUpstreamPriority] = strconv.Itoa(canaryPriority)
+	}
+	return expanded
+}
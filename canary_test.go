@@ -0,0 +1,92 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestParseCanaryHeader(t *testing.T) {
+	tests := []struct {
+		value       string
+		field       string
+		headerValue string
+		err         bool
+	}{
+		{value: "X-Canary", field: "X-Canary", headerValue: "*"},
+		{value: "X-Canary:true", field: "X-Canary", headerValue: "true"},
+		{value: "X-Canary=true", field: "X-Canary", headerValue: "true"},
+		{value: " X-Canary : true ", field: "X-Canary", headerValue: "true"},
+		{value: "X-Canary:", field: "X-Canary", headerValue: "*"},
+		{value: "X-Canary:a:b", field: "X-Canary", headerValue: "a:b"},
+		{value: "", err: true},
+		{value: ":true", err: true},
+		{value: "X Canary:true", err: true},
+		{value: "x.canary:true", err: true},
+	}
+
+	for _, tt := range tests {
+		field, headerValue, err := parseCanaryHeader(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseCanaryHeader(%q) = %q, %q, want error", tt.value, field, headerValue)
+			}
+			continue
+		}
+		if err != nil || field != tt.field || headerValue != tt.headerValue {
+			t.Errorf("parseCanaryHeader(%q) = %q, %q, %v, want %q, %q", tt.value, field, headerValue, err, tt.field, tt.headerValue)
+		}
+	}
+}
+
+func TestCanaryLabelsMatch(t *testing.T) {
+	u := &Upstreams{logger: zap.NewNop()}
+
+	tests := []struct {
+		label   string
+		header  string
+		matches bool
+	}{
+		{label: "X-Canary", header: "1", matches: true},
+		{label: "X-Canary", header: "", matches: false},
+		{label: "X-Canary:true", header: "true", matches: true},
+		{label: "X-Canary=true", header: "true", matches: true},
+		{label: "X-Canary:true", header: "false", matches: false},
+		{label: "X-Canary:true", header: "", matches: false},
+	}
+
+	for _, tt := range tests {
+		labels := u.canaryLabels(map[string]string{LabelCanaryHeader: tt.label})
+		if labels[LabelUpstreamPriority] != "-1" {
+			t.Errorf("canary.header %q: priority label = %q, want -1", tt.label, labels[LabelUpstreamPriority])
+		}
+
+		var sets caddyhttp.MatcherSets
+		for key, value := range labels {
+			matcher, ok, err := produceMatcher(key, value)
+			if err != nil {
+				t.Fatalf("canary.header %q: %v", tt.label, err)
+			}
+			if ok {
+				sets = append(sets, caddyhttp.MatcherSet{matcher})
+			}
+		}
+		if len(sets) != 1 {
+			t.Fatalf("canary.header %q: got %d matchers, want 1", tt.label, len(sets))
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if tt.header != "" {
+			req.Header.Set("X-Canary", tt.header)
+		}
+		if got := sets.AnyMatch(req); got != tt.matches {
+			t.Errorf("canary.header %q with X-Canary %q: match = %v, want %v", tt.label, tt.header, got, tt.matches)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package caddy_docker_upstreams
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// newClient creates a docker client, the configured options take precedence
+// over the DOCKER_* environment variables.
+func (u *Upstreams) newClient(config Endpoint) (*client.Client, error) {
+	// The docker client only fails to dial a named pipe off Windows.
+	if isNpipeHost(endpointHost(config)) && runtime.GOOS != "windows" {
+		return nil, fmt.Errorf("named pipe host '%s' is only supported on windows", endpointHost(config))
+	}
+
+	opts := []client.Opt{client.FromEnv}
+
+	if config.CertPath != "" || config.TLSCA != "" || config.TLSCert != "" || config.TLSKey != "" {
+		opts = append(opts, withTLSConfig(config))
+	}
+
+	switch {
+	case isSSHHost(endpointHost(config)):
+		opts = append(opts, withSSH(endpointHost(config)))
+	case config.Host != "":
+		opts = append(opts, client.WithHost(config.Host))
+	case u.Provider == ProviderPodman && os.Getenv(client.EnvOverrideHost) == "":
+		opts = append(opts, client.WithHost(podmanHost()))
+	}
+
+	if config.APIVersion != "" {
+		opts = append(opts, client.WithVersion(config.APIVersion))
+	} else {
+		opts = append(opts, client.WithAPIVersionNegotiation())
+	}
+
+	return client.NewClientWithOpts(opts...)
+}
+
+// endpointHost returns the configured host of the endpoint, or DOCKER_HOST.
+func endpointHost(config Endpoint) string {
+	if config.Host != "" {
+		return config.Host
+	}
+	return os.Getenv(client.EnvOverrideHost)
+}
+
+// isNpipeHost reports whether the host is a Windows named pipe, e.g.
+// npipe:////./pipe/docker_engine, the default host of docker on Windows.
+func isNpipeHost(host string) bool {
+	return strings.HasPrefix(host, "npipe://")
+}
+
+// podmanHost returns the address of the podman socket, the rootless socket is
+// preferred when it exists.
+func podmanHost() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		path := filepath.Join(dir, "podman", "podman.sock")
+		if _, err := os.Stat(path); err == nil {
+			return "unix://" + path
+		}
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+func withTLSConfig(config Endpoint) client.Opt {
+	return func(c *client.Client) error {
+		tlsConfig, err := clientTLSConfig(config)
+		if err != nil {
+			return fmt.Errorf("unable to create tls config: %w", err)
+		}
+
+		transport, ok := c.HTTPClient().Transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("unable to apply tls config to transport: %T", c.HTTPClient().Transport)
+		}
+
+		transport.TLSClientConfig = tlsConfig
+		return nil
+	}
+}
+
+// clientTLSConfig returns the tls config of the endpoint, the TLS* options
+// take precedence over the files of CertPath. The daemon certificate is
+// verified when TLSVerify or TLSCA is set, a CA being only given to verify it.
+func clientTLSConfig(config Endpoint) (*tls.Config, error) {
+	pem := func(value, file string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN"):
+			return []byte(value), nil
+		case value != "":
+			return os.ReadFile(value)
+		case config.CertPath != "":
+			return os.ReadFile(filepath.Join(config.CertPath, file))
+		default:
+			return nil, nil
+		}
+	}
+
+	tlsConfig := tlsconfig.ClientDefault()
+	tlsConfig.InsecureSkipVerify = !config.TLSVerify && config.TLSCA == ""
+
+	ca, err := pem(config.TLSCA, "ca.pem")
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificate in ca")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	cert, err := pem(config.TLSCert, "cert.pem")
+	if err != nil {
+		return nil, err
+	}
+	key, err := pem(config.TLSKey, "key.pem")
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil || key != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,55 @@
+package caddy_docker_upstreams
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientTLSConfigVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	// The server certificate is the client one too.
+	key, err := x509.MarshalPKCS8PrivateKey(srv.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := t.TempDir()
+	for name, data := range map[string]string{
+		"ca.pem":   ca,
+		"cert.pem": ca,
+		"key.pem":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})),
+	} {
+		if err := os.WriteFile(filepath.Join(certPath, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		config Endpoint
+		verify bool
+	}{
+		{name: "no tls options", config: Endpoint{}, verify: false},
+		{name: "tls_verify", config: Endpoint{TLSVerify: true, TLSCA: ca}, verify: true},
+		{name: "tls_ca without tls_verify", config: Endpoint{TLSCA: ca}, verify: true},
+		{name: "cert_path without tls_verify", config: Endpoint{CertPath: certPath}, verify: false},
+		{name: "cert_path with tls_verify", config: Endpoint{CertPath: certPath, TLSVerify: true}, verify: true},
+	}
+
+	for _, tt := range tests {
+		tlsConfig, err := clientTLSConfig(tt.config)
+		if err != nil {
+			t.Fatalf("%s: unable to create tls config: %v", tt.name, err)
+		}
+		if verify := !tlsConfig.InsecureSkipVerify; verify != tt.verify {
+			t.Errorf("%s: verify = %v, want %v", tt.name, verify, tt.verify)
+		}
+	}
+}
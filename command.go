@@ -0,0 +1,97 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "docker-upstreams",
+		Func:  cmdDockerUpstreams,
+		Usage: "[--host <host>] [--provider <provider>] [--mode <mode>] [--label-prefix <prefix>] [--network <name>] [--published] [--json]",
+		Short: "Prints the upstreams the docker labels would provide",
+		Long: `
+Connects to the docker daemon, evaluates the labels of the containers and
+prints which ones would become upstreams, with their dial address and
+matchers, without starting the server.
+
+The flags are the options of the dynamic docker upstreams of the same name.
+With --json the upstreams are printed as served by the admin API.
+
+The command exits with a non-zero status if labels are invalid, which lints
+the labels of compose files in CI.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("docker-upstreams", flag.ExitOnError)
+			fs.String("host", "", "Address of the docker daemon")
+			fs.String("provider", "", "Provider of the upstreams")
+			fs.String("mode", "", "Either container or swarm")
+			fs.String("label-prefix", "", "Prefix replacing com.caddyserver.http in the labels")
+			fs.String("network", "", "Network whose ip address is dialed")
+			fs.Bool("published", false, "Dial the published ports")
+			fs.Bool("json", false, "Print the upstreams as JSON")
+			return fs
+		}(),
+	})
+}
+
+func cmdDockerUpstreams(fl caddycmd.Flags) (int, error) {
+	u := &Upstreams{
+		Host:              fl.String("host"),
+		Provider:          fl.String("provider"),
+		Mode:              fl.String("mode"),
+		LabelPrefix:       fl.String("label-prefix"),
+		DefaultNetwork:    fl.String("network"),
+		UsePublishedPorts: fl.Bool("published"),
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	err := u.Provision(ctx)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	s := u.instance.loadSnapshot()
+	out := newAdminUpstreams(s.refreshed, s.candidates)
+
+	if fl.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(out)
+	} else {
+		err = printUpstreams(out.Upstreams)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	err = u.labelErrors()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// printUpstreams prints a row per upstream with its sorted matcher labels.
+func printUpstreams(upstreams []adminUpstream) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tNAME\tADDRESS\tMATCHERS")
+	for _, upstream := range upstreams {
+		matchers := make([]string, 0, len(upstream.Matchers))
+		for _, key := range sortedKeys(upstream.Matchers) {
+			matchers = append(matchers, strings.TrimPrefix(key, labelMatchPrefix)+"="+upstream.Matchers[key])
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", upstream.Endpoint, upstream.Name, upstream.Address, strings.Join(matchers, " "))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,117 @@
+package caddy_docker_upstreams
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// composeKey identifies an upstream of a compose service.
+type composeKey struct {
+	endpoint, project, service, upstream string
+}
+
+// composeKeyOf returns the compose service of the candidate, if any.
+func composeKeyOf(c candidate) (composeKey, bool) {
+	service, ok := c.labels[composeServiceLabel]
+	if !ok {
+		return composeKey{}, false
+	}
+	return composeKey{c.endpoint, c.labels[composeProjectLabel], service, c.upstreamName}, true
+}
+
+// shareComposeMatchers makes the replicas of every compose service share the
+// matchers and the selection policy of the replica with the lowest name, so
+// they form a single pool. Replicas whose matcher labels disagree are
+// reported since only one of them is honored.
+func (u *Upstreams) shareComposeMatchers(updated []candidate) {
+	references := make(map[composeKey]int)
+	for i, c := range updated {
+		key, ok := composeKeyOf(c)
+		if !ok {
+			continue
+		}
+
+		if ref, ok := references[key]; !ok || c.name < updated[ref].name {
+			references[key] = i
+		}
+	}
+
+	for i, c := range updated {
+		key, ok := composeKeyOf(c)
+		if !ok {
+			continue
+		}
+
+		ref := updated[references[key]]
+		if ref.name == c.name {
+			continue
+		}
+
+		if groupKey(c.labels) != groupKey(ref.labels) {
+			u.logger.Warn("replicas of compose service have conflicting matcher labels",
+				zap.String("endpoint", c.endpoint),
+				zap.String("service", key.service),
+				zap.String("container_name", c.name),
+				zap.String("reference_name", ref.name),
+			)
+		}
+
+		updated[i].matchers = ref.matchers
+		updated[i].group = ref.group
+		updated[i].policy = ref.policy
+	}
+}
+
+// keepReplaced keeps the previous candidates of the compose services which
+// have none left, e.g. while `docker compose up` recreates their container,
+// until a replacement is a candidate or for at most RecreateTimeout.
+func (u *Upstreams) keepReplaced(previous, updated []candidate) []candidate {
+	present := make(map[composeKey]struct{})
+	for _, c := range updated {
+		if key, ok := composeKeyOf(c); ok {
+			present[key] = struct{}{}
+		}
+	}
+	for key := range u.replaced {
+		if _, ok := present[key]; ok {
+			delete(u.replaced, key)
+		}
+	}
+
+	timeout := time.Duration(u.RecreateTimeout)
+	for _, c := range previous {
+		key, ok := composeKeyOf(c)
+		if !ok {
+			continue
+		}
+		if _, ok := present[key]; ok {
+			continue
+		}
+
+		since, ok := u.replaced[key]
+		if !ok {
+			since = time.Now()
+			u.replaced[key] = since
+
+			// Drop the candidate once the timeout is over.
+			for _, e := range u.endpoints {
+				if e.name == c.endpoint {
+					e.scheduleUpdate(timeout, "")
+				}
+			}
+		}
+		if time.Since(since) >= timeout {
+			continue
+		}
+
+		u.logger.Debug("keep container until it is replaced",
+			zap.String("endpoint", c.endpoint),
+			zap.String("service", key.service),
+			zap.String("container_name", c.name),
+		)
+		updated = append(updated, c)
+	}
+
+	return updated
+}
@@ -0,0 +1,369 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const defaultContainerdAddress = "unix:///run/containerd/containerd.sock"
+
+// defaultPollInterval is the interval the pods are listed at when
+// ResyncInterval is not set, the CRI having no event stream fit for it.
+const defaultPollInterval = 5 * time.Second
+
+const criRuntimeService = "/runtime.v1.RuntimeService/"
+
+// criClient is a client of the CRI runtime service of containerd. The
+// messages are encoded by hand, which spares the dependency on the CRI API.
+type criClient struct {
+	address string
+	conn    *grpc.ClientConn
+}
+
+// newCRIClient creates a CRI client, the configured host takes precedence
+// over the CONTAINERD_ADDRESS environment variable.
+func newCRIClient(config Endpoint) (*criClient, error) {
+	address := config.Host
+	if address == "" {
+		address = os.Getenv("CONTAINERD_ADDRESS")
+	}
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+	if strings.HasPrefix(address, "/") {
+		address = "unix://" + address
+	}
+
+	conn, err := grpc.Dial(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial containerd: %w", err)
+	}
+
+	return &criClient{address: address, conn: conn}, nil
+}
+
+// call invokes the method of the runtime service with the encoded request,
+// and returns the encoded response.
+func (c *criClient) call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	var resp []byte
+	err := c.conn.Invoke(ctx, criRuntimeService+method, &req, &resp)
+	return resp, err
+}
+
+// ping checks the runtime answers.
+func (c *criClient) ping(ctx context.Context) error {
+	_, err := c.call(ctx, "Version", nil)
+	return err
+}
+
+// criPod is a ready pod sandbox.
+type criPod struct {
+	id        string
+	name      string
+	namespace string
+	uid       string
+	// labels are the labels and the annotations of the pod, read as labels.
+	labels map[string]string
+	ipv4   string
+	ipv6   string
+}
+
+// listPods lists the ready pod sandboxes, the ip addresses of the pods
+// already known are reused.
+func (c *criClient) listPods(ctx context.Context, known []criPod) ([]criPod, error) {
+	// ListPodSandboxRequest{filter: {state: {state: SANDBOX_READY}}}
+	state := protowire.AppendTag(nil, 2, protowire.BytesType)
+	state = protowire.AppendBytes(state, nil)
+	req := protowire.AppendTag(nil, 1, protowire.BytesType)
+	req = protowire.AppendBytes(req, state)
+
+	resp, err := c.call(ctx, "ListPodSandbox", req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the list of pods: %w", err)
+	}
+
+	ips := make(map[string]criPod, len(known))
+	for _, pod := range known {
+		ips[pod.id] = pod
+	}
+
+	var pods []criPod
+	err = protoFields(resp, func(num protowire.Number, b []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		pod, err := decodePodSandbox(b)
+		if err != nil {
+			return err
+		}
+
+		if old, ok := ips[pod.id]; ok {
+			pod.ipv4, pod.ipv6 = old.ipv4, old.ipv6
+		} else {
+			err = c.podIPs(ctx, &pod)
+			if err != nil {
+				return err
+			}
+		}
+		pods = append(pods, pod)
+		return nil
+	})
+	return pods, err
+}
+
+// podIPs sets the ip addresses of the pod from its status.
+func (c *criClient) podIPs(ctx context.Context, pod *criPod) error {
+	// PodSandboxStatusRequest{pod_sandbox_id: id}
+	req := protowire.AppendTag(nil, 1, protowire.BytesType)
+	req = protowire.AppendString(req, pod.id)
+
+	resp, err := c.call(ctx, "PodSandboxStatus", req)
+	if err != nil {
+		return fmt.Errorf("unable to get the status of pod '%s': %w", pod.name, err)
+	}
+
+	setIP := func(ip string) {
+		switch {
+		case ip == "":
+		case strings.Contains(ip, ":"):
+			if pod.ipv6 == "" {
+				pod.ipv6 = ip
+			}
+		default:
+			if pod.ipv4 == "" {
+				pod.ipv4 = ip
+			}
+		}
+	}
+
+	// PodSandboxStatusResponse{status: {network: {ip, additional_ips: [{ip}]}}}
+	return protoFields(resp, func(num protowire.Number, b []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		return protoFields(b, func(num protowire.Number, b []byte, _ uint64) error {
+			if num != 5 {
+				return nil
+			}
+			return protoFields(b, func(num protowire.Number, b []byte, _ uint64) error {
+				switch num {
+				case 1:
+					setIP(string(b))
+				case 2:
+					return protoFields(b, func(num protowire.Number, b []byte, _ uint64) error {
+						if num == 1 {
+							setIP(string(b))
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		})
+	})
+}
+
+// decodePodSandbox decodes a PodSandbox message.
+func decodePodSandbox(b []byte) (criPod, error) {
+	pod := criPod{labels: make(map[string]string)}
+	annotations := make(map[string]string)
+
+	err := protoFields(b, func(num protowire.Number, b []byte, _ uint64) error {
+		switch num {
+		case 1:
+			pod.id = string(b)
+		case 2:
+			return protoFields(b, func(num protowire.Number, b []byte, _ uint64) error {
+				switch num {
+				case 1:
+					pod.name = string(b)
+				case 2:
+					pod.uid = string(b)
+				case 3:
+					pod.namespace = string(b)
+				}
+				return nil
+			})
+		case 5:
+			return decodeMapEntry(b, pod.labels)
+		case 6:
+			return decodeMapEntry(b, annotations)
+		}
+		return nil
+	})
+
+	for key, value := range annotations {
+		pod.labels[key] = value
+	}
+	return pod, err
+}
+
+func decodeMapEntry(b []byte, m map[string]string) error {
+	var key, value string
+	err := protoFields(b, func(num protowire.Number, b []byte, _ uint64) error {
+		switch num {
+		case 1:
+			key = string(b)
+		case 2:
+			value = string(b)
+		}
+		return nil
+	})
+	m[key] = value
+	return err
+}
+
+// protoFields calls fn with the fields of the message, b is the value of the
+// length delimited fields and v the value of the varint fields.
+func protoFields(msg []byte, fn func(num protowire.Number, b []byte, v uint64) error) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		var err error
+		switch typ {
+		case protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(msg)
+			if n >= 0 {
+				err = fn(num, b, 0)
+			}
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(msg)
+			if n >= 0 {
+				err = fn(num, nil, v)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
+
+// rawCodec passes the messages encoded by hand to grpc as is.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// criProvider provides the ready pods of containerd, listed every interval
+// since the CRI has no event stream fit for it.
+type criProvider struct {
+	client   *criClient
+	logger   *zap.Logger
+	interval time.Duration
+	// pickIP picks the ip address of a pod, see IPVersion.
+	pickIP func(ipv4, ipv6 string) string
+	// pods are the pods last listed, whose ip addresses are reused. The
+	// targets are listed by one refresh at a time.
+	pods []criPod
+}
+
+func newCRIProvider(u *Upstreams, config Endpoint) (Provider, string, error) {
+	client, err := newCRIClient(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	interval := time.Duration(u.ResyncInterval)
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	return &criProvider{client: client, logger: u.logger, interval: interval, pickIP: u.pickIP}, client.address, nil
+}
+
+// List returns the ready pods having an ip address.
+func (p *criProvider) List(ctx context.Context) ([]Target, error) {
+	pods, err := p.client.listPods(ctx, p.pods)
+	if err != nil {
+		return nil, err
+	}
+	p.pods = pods
+
+	targets := make([]Target, 0, len(pods))
+	for _, pod := range pods {
+		ip := p.pickIP(pod.ipv4, pod.ipv6)
+		if ip == "" {
+			p.logger.Error("unable to get ip address from pod network",
+				zap.String("pod_id", pod.id),
+			)
+			continue
+		}
+		targets = append(targets, Target{
+			ID:           pod.id,
+			Name:         pod.name,
+			Address:      ip,
+			Labels:       pod.labels,
+			Kind:         "pod",
+			Placeholders: podPlaceholders(pod),
+		})
+	}
+	return targets, nil
+}
+
+// podPlaceholders returns the placeholders of the pod labels.
+func podPlaceholders(pod criPod) map[string]string {
+	return map[string]string{
+		"pod.name":      pod.name,
+		"pod.namespace": pod.namespace,
+		"pod.uid":       pod.uid,
+		"pod.id":        pod.id,
+		"pod.id.short":  shortID(pod.id),
+	}
+}
+
+// Watch notifies every interval.
+func (p *criProvider) Watch(ctx context.Context, notify func()) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			notify()
+		}
+	}
+}
+
+// Ping checks the runtime answers.
+func (p *criProvider) Ping(ctx context.Context) error {
+	return p.client.ping(ctx)
+}
+
+// Interface guards
+var (
+	_ Provider = (*criProvider)(nil)
+	_ Pinger   = (*criProvider)(nil)
+)
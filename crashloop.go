@@ -0,0 +1,97 @@
+package caddy_docker_upstreams
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCrashLoopBackoff = 30 * time.Second
+	maxCrashLoopBackoff     = 10 * time.Minute
+
+	// crashLoopWindow is the period the restarts of a container are counted
+	// over.
+	crashLoopWindow = 5 * time.Minute
+)
+
+// crashLoop tracks the exits of a container.
+type crashLoop struct {
+	dies    []time.Time
+	backoff time.Duration
+	until   time.Time
+}
+
+// recordDie counts an exit of the container, and returns the backoff it is
+// quarantined for once it exits restarts times within crashLoopWindow. The
+// backoff doubles for every following loop, and is reset once the container
+// doesn't exit within crashLoopWindow.
+func (e *endpoint) recordDie(id string, restarts int, backoff time.Duration) (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.crashLoops == nil {
+		e.crashLoops = make(map[string]*crashLoop)
+	}
+	l, ok := e.crashLoops[id]
+	if !ok {
+		l = new(crashLoop)
+		e.crashLoops[id] = l
+	}
+
+	now := time.Now()
+	dies := l.dies[:0]
+	for _, t := range l.dies {
+		if now.Sub(t) < crashLoopWindow {
+			dies = append(dies, t)
+		}
+	}
+	if len(dies) == 0 && now.After(l.until.Add(crashLoopWindow)) {
+		l.backoff = 0
+	}
+	l.dies = append(dies, now)
+
+	if len(l.dies) < restarts {
+		return 0, false
+	}
+
+	switch {
+	case l.backoff == 0:
+		l.backoff = backoff
+	case l.backoff < maxCrashLoopBackoff:
+		l.backoff *= 2
+		if l.backoff > maxCrashLoopBackoff {
+			l.backoff = maxCrashLoopBackoff
+		}
+	}
+	l.dies = nil
+	l.until = now.Add(l.backoff)
+	return l.backoff, true
+}
+
+// isCrashLooping reports whether the container is quarantined for restarting
+// in a loop.
+func (e *endpoint) isCrashLooping(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	l, ok := e.crashLoops[id]
+	return ok && time.Now().Before(l.until)
+}
+
+// crashed records the exit of the container, and quarantines it if it
+// restarts in a loop. The container is listed again when the backoff is over.
+func (u *Upstreams) crashed(e *endpoint, id string) {
+	backoff, ok := e.recordDie(id, u.CrashLoopRestarts, time.Duration(u.CrashLoopBackoff))
+	if !ok {
+		return
+	}
+
+	u.logger.Warn("quarantine container restarting in a loop",
+		zap.String("endpoint", e.name),
+		zap.String("container_id", id),
+		zap.Int("restarts", u.CrashLoopRestarts),
+		zap.Duration("backoff", backoff),
+	)
+	e.scheduleUpdate(backoff, id)
+}
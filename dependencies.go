@@ -0,0 +1,167 @@
+package caddy_docker_upstreams
+
+import (
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const composeDependsOnLabel = "com.docker.compose.depends_on"
+
+// The conditions of the compose depends_on entries.
+const (
+	conditionStarted   = "service_started"
+	conditionHealthy   = "service_healthy"
+	conditionCompleted = "service_completed_successfully"
+)
+
+// composeService identifies a service of a compose project.
+type composeService struct {
+	project, service string
+}
+
+// dependency is an entry of the depends_on label, e.g. db:service_healthy:false.
+type dependency struct {
+	service, condition string
+}
+
+// parseDependsOn returns the entries of the depends_on label, the condition
+// defaulting to service_started.
+func parseDependsOn(value string) []dependency {
+	var dependencies []dependency
+	for _, entry := range strings.Split(value, ",") {
+		service, rest, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if service == "" {
+			continue
+		}
+		condition, _, _ := strings.Cut(rest, ":")
+		if condition == "" {
+			condition = conditionStarted
+		}
+		dependencies = append(dependencies, dependency{service, condition})
+	}
+	return dependencies
+}
+
+// listedContainers returns the containers of all which the daemon lists
+// without the All option and with the label filters, that is the running
+// ones having the labels.
+func listedContainers(all []types.Container, args filters.Args) []types.Container {
+	containers := make([]types.Container, 0, len(all))
+	for _, container := range all {
+		switch container.State {
+		case "running", "paused", "restarting":
+		default:
+			continue
+		}
+		if args.MatchKVList("label", container.Labels) {
+			containers = append(containers, container)
+		}
+	}
+	return containers
+}
+
+// readDependencies reads the containers of the services the containers of
+// the endpoint depend on from all the containers of the daemon, listed by
+// the refresh even when stopped or without the enable label. Guarded by
+// refreshMu and mu.
+func (e *endpoint) readDependencies(all []types.Container) {
+	dependencies := make(map[composeService][]types.Container)
+	for _, container := range e.containers {
+		value, ok := container.Labels[composeDependsOnLabel]
+		if !ok {
+			continue
+		}
+		project := container.Labels[composeProjectLabel]
+		for _, d := range parseDependsOn(value) {
+			dependencies[composeService{project, d.service}] = nil
+		}
+	}
+
+	for _, container := range all {
+		key := composeService{container.Labels[composeProjectLabel], container.Labels[composeServiceLabel]}
+		if _, ok := dependencies[key]; ok {
+			dependencies[key] = append(dependencies[key], container)
+		}
+	}
+
+	e.mu.Lock()
+	e.dependencies = dependencies
+	e.mu.Unlock()
+}
+
+// untrackedDependency reports whether one of the containers depends on a
+// service which the last refresh didn't read, which takes a full refresh.
+func (e *endpoint) untrackedDependency(containers []types.Container) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, container := range containers {
+		value, ok := container.Labels[composeDependsOnLabel]
+		if !ok {
+			continue
+		}
+		project := container.Labels[composeProjectLabel]
+		for _, d := range parseDependsOn(value) {
+			if _, ok := e.dependencies[composeService{project, d.service}]; !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unmetDependency returns the first service the container depends on whose
+// condition isn't met, e.g. a database which is not healthy yet.
+func (e *endpoint) unmetDependency(container types.Container) (string, bool) {
+	value, ok := container.Labels[composeDependsOnLabel]
+	if !ok {
+		return "", false
+	}
+
+	project := container.Labels[composeProjectLabel]
+	for _, d := range parseDependsOn(value) {
+		if !dependencyMet(e.dependencies[composeService{project, d.service}], d.condition) {
+			return d.service, true
+		}
+	}
+	return "", false
+}
+
+// dependencyMet reports whether a container of the service meets the
+// condition.
+func dependencyMet(containers []types.Container, condition string) bool {
+	for _, container := range containers {
+		switch condition {
+		case conditionHealthy:
+			if container.State == "running" && containerHealth(container) == types.Healthy {
+				return true
+			}
+		case conditionCompleted:
+			if container.State == "exited" && strings.HasPrefix(container.Status, "Exited (0)") {
+				return true
+			}
+		default:
+			if container.State == "running" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDependency reports whether the labels of an event are the ones of a
+// container of a service depended on.
+func (e *endpoint) isDependency(attributes map[string]string) bool {
+	project, ok := attributes[composeProjectLabel]
+	if !ok {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, ok = e.dependencies[composeService{project, attributes[composeServiceLabel]}]
+	return ok
+}
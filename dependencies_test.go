@@ -0,0 +1,58 @@
+package caddy_docker_upstreams
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+func TestReadDependencies(t *testing.T) {
+	app := types.Container{ID: "app", State: "running", Labels: map[string]string{
+		LabelEnable:           "true",
+		composeProjectLabel:   "shop",
+		composeServiceLabel:   "app",
+		composeDependsOnLabel: "db:service_healthy:false,migrate:service_completed_successfully:false",
+	}}
+	db := types.Container{ID: "db", State: "running", Status: "Up 1 minute (healthy)", Labels: map[string]string{
+		composeProjectLabel: "shop",
+		composeServiceLabel: "db",
+	}}
+	migrate := types.Container{ID: "migrate", State: "exited", Status: "Exited (1) 1 minute ago", Labels: map[string]string{
+		composeProjectLabel: "shop",
+		composeServiceLabel: "migrate",
+	}}
+	other := types.Container{ID: "other", State: "running", Labels: map[string]string{
+		composeProjectLabel: "blog",
+		composeServiceLabel: "db",
+	}}
+	all := []types.Container{app, db, migrate, other}
+
+	e := &endpoint{}
+	e.containers = listedContainers(all, filters.NewArgs(filters.Arg("label", LabelEnable)))
+	if len(e.containers) != 1 || e.containers[0].ID != app.ID {
+		t.Fatalf("listed containers = %v, want only app", e.containers)
+	}
+	e.readDependencies(all)
+
+	if service, ok := e.unmetDependency(app); !ok || service != "migrate" {
+		t.Errorf("unmetDependency() = %q, %v, want migrate", service, ok)
+	}
+	if !e.isDependency(db.Labels) || e.isDependency(other.Labels) {
+		t.Error("only the services of the project depended on are dependencies")
+	}
+
+	migrate.Status = "Exited (0) 1 minute ago"
+	e.readDependencies([]types.Container{app, db, migrate})
+	if service, ok := e.unmetDependency(app); ok {
+		t.Errorf("unmetDependency() = %q, want none", service)
+	}
+
+	added := types.Container{ID: "worker", Labels: map[string]string{
+		composeProjectLabel:   "shop",
+		composeDependsOnLabel: "queue:service_started:false",
+	}}
+	if e.untrackedDependency([]types.Container{app}) || !e.untrackedDependency([]types.Container{added}) {
+		t.Error("only the dependencies not read by the refresh are untracked")
+	}
+}
@@ -0,0 +1,46 @@
+package caddy_docker_upstreams
+
+import (
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// defaultPortPreference are the ports detected among several ones when
+// PortPreference is not set.
+var defaultPortPreference = []string{"http", "80", "8080", "3000", "8000"}
+
+// detectPort returns the single port of ports, or among several the first
+// port of the preference list by number or name. Ports maps the port numbers
+// to their name if any, fields identify the object in logs.
+func (u *Upstreams) detectPort(ports map[int]string, fields ...zap.Field) (string, bool) {
+	if len(ports) == 1 {
+		for port := range ports {
+			return strconv.Itoa(port), true
+		}
+	}
+
+	numbers := make([]int, 0, len(ports))
+	for port := range ports {
+		numbers = append(numbers, port)
+	}
+	sort.Ints(numbers)
+
+	preference := u.PortPreference
+	if len(preference) == 0 {
+		preference = defaultPortPreference
+	}
+	for _, preferred := range preference {
+		for _, port := range numbers {
+			if strconv.Itoa(port) == preferred || ports[port] == preferred {
+				u.logger.Debug("detect preferred port among several", append(fields,
+					zap.Int("port", port),
+					zap.Ints("ports", numbers),
+				)...)
+				return strconv.Itoa(port), true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,282 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(ECS{})
+}
+
+const (
+	ecsTargetPrefix = "AmazonEC2ContainerServiceV20141113."
+
+	defaultECSInterval = 10 * time.Second
+
+	// ecsDescribeTasksLimit is the largest number of tasks described at once.
+	ecsDescribeTasksLimit = 100
+)
+
+// ECS provides the running tasks of an ECS cluster. The labels are the
+// docker labels of the container definitions, and the tasks are dialed on
+// the ip address of their elastic network interface, so only the tasks of
+// the awsvpc network mode are discovered.
+type ECS struct {
+	// Cluster is the name or the ARN of the cluster. Defaults to the
+	// default cluster.
+	Cluster string `json:"cluster,omitempty"`
+	// Region is the region of the cluster. Defaults to AWS_REGION, or the
+	// region of the EC2 instance.
+	Region string `json:"region,omitempty"`
+	// Interval is the interval the tasks are listed at. Defaults to 10s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	client *awsClient
+
+	// definitions caches the container definitions by task definition
+	// ARN, which are immutable. The targets are listed by one refresh at a
+	// time.
+	definitions map[string][]ecsContainerDefinition
+}
+
+func (ECS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  providersNamespace + ".ecs",
+		New: func() caddy.Module { return new(ECS) },
+	}
+}
+
+func (p *ECS) Provision(ctx caddy.Context) error {
+	if p.Interval == 0 {
+		p.Interval = caddy.Duration(defaultECSInterval)
+	}
+
+	p.client = &awsClient{service: "ecs", http: &http.Client{Timeout: 30 * time.Second}}
+	p.definitions = make(map[string][]ecsContainerDefinition)
+
+	p.client.region = p.Region
+	if p.client.region == "" {
+		p.client.region = os.Getenv("AWS_REGION")
+	}
+	if p.client.region == "" {
+		p.client.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if p.client.region == "" {
+		region, err := p.client.instanceRegion(ctx)
+		if err != nil {
+			return errors.New("no ecs region, and unable to read the region of the instance")
+		}
+		p.client.region = region
+	}
+
+	return nil
+}
+
+type ecsContainerDefinition struct {
+	Name         string            `json:"name"`
+	DockerLabels map[string]string `json:"dockerLabels"`
+}
+
+type ecsTask struct {
+	TaskArn           string `json:"taskArn"`
+	TaskDefinitionArn string `json:"taskDefinitionArn"`
+	LastStatus        string `json:"lastStatus"`
+	Containers        []struct {
+		Name            string `json:"name"`
+		LastStatus      string `json:"lastStatus"`
+		NetworkBindings []struct {
+			ContainerPort int `json:"containerPort"`
+		} `json:"networkBindings"`
+		NetworkInterfaces []struct {
+			PrivateIPv4Address string `json:"privateIpv4Address"`
+		} `json:"networkInterfaces"`
+	} `json:"containers"`
+}
+
+// List returns the containers of the running tasks of the cluster having
+// docker labels.
+func (p *ECS) List(ctx context.Context) ([]Target, error) {
+	var arns []string
+	for token := ""; ; {
+		var out struct {
+			TaskArns  []string `json:"taskArns"`
+			NextToken string   `json:"nextToken"`
+		}
+		in := map[string]any{"desiredStatus": "RUNNING"}
+		if p.Cluster != "" {
+			in["cluster"] = p.Cluster
+		}
+		if token != "" {
+			in["nextToken"] = token
+		}
+		err := p.client.do(ctx, ecsTargetPrefix+"ListTasks", in, &out)
+		if err != nil {
+			return nil, err
+		}
+
+		arns = append(arns, out.TaskArns...)
+		if token = out.NextToken; token == "" {
+			break
+		}
+	}
+
+	var targets []Target
+	for len(arns) > 0 {
+		n := len(arns)
+		if n > ecsDescribeTasksLimit {
+			n = ecsDescribeTasksLimit
+		}
+
+		var out struct {
+			Tasks []ecsTask `json:"tasks"`
+		}
+		in := map[string]any{"tasks": arns[:n]}
+		if p.Cluster != "" {
+			in["cluster"] = p.Cluster
+		}
+		err := p.client.do(ctx, ecsTargetPrefix+"DescribeTasks", in, &out)
+		if err != nil {
+			return nil, err
+		}
+		arns = arns[n:]
+
+		for _, task := range out.Tasks {
+			if task.LastStatus != "RUNNING" {
+				continue
+			}
+
+			definitions, err := p.containerDefinitions(ctx, task.TaskDefinitionArn)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, container := range task.Containers {
+				labels := definitions[container.Name]
+				if container.LastStatus != "RUNNING" || len(labels) == 0 || len(container.NetworkInterfaces) == 0 {
+					continue
+				}
+
+				address := container.NetworkInterfaces[0].PrivateIPv4Address
+				if len(container.NetworkBindings) == 1 {
+					address = net.JoinHostPort(address, strconv.Itoa(container.NetworkBindings[0].ContainerPort))
+				}
+
+				targets = append(targets, Target{
+					ID:      task.TaskArn + "/" + container.Name,
+					Name:    container.Name + "." + ecsTaskID(task.TaskArn),
+					Address: address,
+					Labels:  labels,
+				})
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+// containerDefinitions returns the docker labels of the containers of the
+// task definition by container name.
+func (p *ECS) containerDefinitions(ctx context.Context, arn string) (map[string]map[string]string, error) {
+	definitions, ok := p.definitions[arn]
+	if !ok {
+		var out struct {
+			TaskDefinition struct {
+				ContainerDefinitions []ecsContainerDefinition `json:"containerDefinitions"`
+			} `json:"taskDefinition"`
+		}
+		err := p.client.do(ctx, ecsTargetPrefix+"DescribeTaskDefinition", map[string]any{
+			"taskDefinition": arn,
+		}, &out)
+		if err != nil {
+			return nil, err
+		}
+
+		definitions = out.TaskDefinition.ContainerDefinitions
+		p.definitions[arn] = definitions
+	}
+
+	labels := make(map[string]map[string]string, len(definitions))
+	for _, definition := range definitions {
+		labels[definition.Name] = definition.DockerLabels
+	}
+	return labels, nil
+}
+
+// ecsTaskID returns the id at the end of the task ARN.
+func ecsTaskID(arn string) string {
+	return arn[strings.LastIndexByte(arn, '/')+1:]
+}
+
+// Watch notifies every Interval, the ECS API having no change feed.
+func (p *ECS) Watch(ctx context.Context, notify func()) error {
+	ticker := time.NewTicker(time.Duration(p.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			notify()
+		}
+	}
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into p.
+//
+//	provider ecs {
+//		cluster  <name>
+//		region   <region>
+//		interval <duration>
+//	}
+func (p *ECS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "cluster":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				p.Cluster = d.Val()
+			case "region":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				p.Region = d.Val()
+			case "interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad interval value '%s': %v", d.Val(), err)
+				}
+				p.Interval = caddy.Duration(dur)
+			default:
+				return d.Errf("unrecognized ecs option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*ECS)(nil)
+	_ caddyfile.Unmarshaler = (*ECS)(nil)
+	_ Provider              = (*ECS)(nil)
+)
@@ -0,0 +1,275 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// Endpoint is a docker daemon to discover upstreams from, see Upstreams
+// for the meaning of the connection options.
+type Endpoint struct {
+	// Name identifies the endpoint in logs. Defaults to endpoint<index>.
+	Name       string `json:"name,omitempty"`
+	Host       string `json:"host,omitempty"`
+	APIVersion string `json:"api_version,omitempty"`
+	CertPath   string `json:"cert_path,omitempty"`
+	TLSVerify  bool   `json:"tls_verify,omitempty"`
+	TLSCA      string `json:"tls_ca,omitempty"`
+	TLSCert    string `json:"tls_cert,omitempty"`
+	TLSKey     string `json:"tls_key,omitempty"`
+}
+
+// endpoint holds the client of a docker daemon and the objects last listed
+// from it.
+type endpoint struct {
+	name string
+	host string
+	cli  *client.Client
+	// provider is the provider of the endpoint, other than docker and
+	// podman.
+	provider Provider
+	// apiTimeout bounds the requests to the daemon, see apiContext.
+	apiTimeout time.Duration
+	// limiter limits the rate of the requests listing and inspecting the
+	// containers, see APIRateLimit.
+	limiter *rate.Limiter
+	// noPing and noEvents are set when the ping and events endpoints of
+	// the daemon are disabled, see DisableAPI.
+	noPing   bool
+	noEvents bool
+	wakeup   chan struct{}
+
+	containers []types.Container
+	services   []swarm.Service
+	tasks      []swarm.Task
+	// targets are the targets of provider, with their labels read.
+	targets []Target
+	// caddyNetworks holds the ids and names of the networks of the
+	// container Caddy runs in, nil if unknown, see CaddyNetworks.
+	caddyNetworks       map[string]struct{}
+	caddyNetworksWarned bool
+	// dependencies holds the containers of the compose services the
+	// containers depend on, see WaitDependencies.
+	dependencies map[composeService][]types.Container
+	// envs caches the environment variables of the containers.
+	envs map[string][]string
+	// summary counts the objects through the last rebuild of the
+	// candidates.
+	summary refreshSummary
+	// logged is the summary last logged at the info level.
+	logged refreshSummary
+	// confirmed is the time the objects were last listed.
+	confirmed time.Time
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+	full    bool
+	// stopping holds the containers being stopped, which may still be
+	// listed as running while they shut down.
+	stopping map[string]struct{}
+	// crashLoops holds the exits of the containers, to quarantine the ones
+	// restarting in a loop.
+	crashLoops map[string]*crashLoop
+	// restarting holds when the containers kept by keepRestarted were
+	// stopped.
+	restarting map[string]time.Time
+}
+
+// newEndpoint connects to the endpoint of a built-in provider other than
+// docker and podman.
+func (u *Upstreams) newEndpoint(ctx context.Context, name string, config Endpoint) (*endpoint, error) {
+	provider, host, err := builtinProviders[u.Provider](u, config)
+	if err != nil {
+		return nil, err
+	}
+	e := &endpoint{
+		name:       name,
+		host:       host,
+		provider:   provider,
+		apiTimeout: time.Duration(u.APITimeout),
+		wakeup:     make(chan struct{}, 1),
+	}
+
+	err = e.ping(ctx)
+	if err != nil && u.LazyConnect {
+		u.logger.Warn("unable to connect to endpoint; will retry",
+			zap.String("endpoint", name),
+			zap.Error(err),
+		)
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to endpoint '%s': %w", name, err)
+	}
+
+	u.logger.Info("endpoint is connected",
+		zap.String("endpoint", name),
+		zap.String("provider", u.Provider),
+		zap.String("host", e.host),
+	)
+	return e, nil
+}
+
+// publishedHost returns the host to dial the ports published on all
+// interfaces, which is the daemon host for tcp and ssh endpoints.
+func (e *endpoint) publishedHost() string {
+	if isSSHHost(e.host) {
+		return sshHostname(e.host)
+	}
+
+	hostURL, err := client.ParseHostURL(e.cli.DaemonHost())
+	if err == nil && hostURL.Scheme == "tcp" {
+		if host, _, err := net.SplitHostPort(hostURL.Host); err == nil {
+			return host
+		}
+	}
+	return "127.0.0.1"
+}
+
+// ping checks the daemon, the Nomad agent, the Kubernetes API server or
+// containerd of the endpoint answers.
+func (e *endpoint) ping(ctx context.Context) error {
+	ctx, cancel := e.apiContext(ctx)
+	defer cancel()
+
+	if e.provider != nil {
+		if p, ok := e.provider.(Pinger); ok {
+			return p.Ping(ctx)
+		}
+		return nil
+	}
+	_, err := pingDocker(ctx, e.cli, e.noPing)
+	return err
+}
+
+// apiContext returns the context of a request to the daemon, canceled after
+// the API timeout so a hung daemon doesn't block the refreshes.
+func (e *endpoint) apiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if e.apiTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, e.apiTimeout)
+}
+
+// newLimiter returns the rate limiter of the requests to a daemon, nil if
+// the rate isn't limited.
+func (u *Upstreams) newLimiter() *rate.Limiter {
+	if u.APIRateLimit <= 0 {
+		return nil
+	}
+	burst := int(math.Ceil(u.APIRateLimit))
+	return rate.NewLimiter(rate.Limit(u.APIRateLimit), burst)
+}
+
+// throttle waits until the rate limit of the endpoint allows a request to
+// the daemon.
+func (e *endpoint) throttle(ctx context.Context) error {
+	if e.limiter == nil {
+		return nil
+	}
+	return e.limiter.Wait(ctx)
+}
+
+// update marks the container to be listed again by the next refresh, an
+// empty id requests a full refresh.
+func (e *endpoint) update(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if id == "" {
+		e.full = true
+		return
+	}
+
+	if e.pending == nil {
+		e.pending = make(map[string]struct{})
+	}
+	e.pending[id] = struct{}{}
+}
+
+// takeUpdates returns and resets the updates requested since the last call.
+func (e *endpoint) takeUpdates() ([]string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ids := make([]string, 0, len(e.pending))
+	for id := range e.pending {
+		ids = append(ids, id)
+	}
+
+	full := e.full
+	e.pending = nil
+	e.full = false
+
+	return ids, full
+}
+
+// setStopping marks or unmarks the container as being stopped.
+func (e *endpoint) setStopping(id string, stopping bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !stopping {
+		delete(e.stopping, id)
+		return
+	}
+
+	if e.stopping == nil {
+		e.stopping = make(map[string]struct{})
+	}
+	e.stopping[id] = struct{}{}
+}
+
+// isStopping reports whether the container is being stopped.
+func (e *endpoint) isStopping(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, ok := e.stopping[id]
+	return ok
+}
+
+// forgetStopping drops the stopping and crash looping containers which are
+// not listed anymore.
+func (e *endpoint) forgetStopping() {
+	exists := make(map[string]struct{}, len(e.containers))
+	for _, container := range e.containers {
+		exists[container.ID] = struct{}{}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for id := range e.stopping {
+		if _, ok := exists[id]; !ok {
+			delete(e.stopping, id)
+		}
+	}
+	for id := range e.crashLoops {
+		if _, ok := exists[id]; !ok {
+			delete(e.crashLoops, id)
+		}
+	}
+}
+
+// scheduleUpdate requests a refresh of the container after d.
+func (e *endpoint) scheduleUpdate(d time.Duration, id string) {
+	time.AfterFunc(d, func() {
+		e.update(id)
+
+		select {
+		case e.wakeup <- struct{}{}:
+		default:
+		}
+	})
+}
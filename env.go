@@ -0,0 +1,191 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"go.uber.org/zap"
+)
+
+// envPrefix is the prefix of the environment variables of the labels, which
+// are named after the labels without the default prefix, e.g.
+// CADDY_UPSTREAM_PORT for com.caddyserver.http.upstream.port.
+const envPrefix = "CADDY_"
+
+// envLabels maps the environment variables to the labels.
+var envLabels = func() map[string]string {
+	labels := []string{
+		LabelEnable,
+		LabelUpstreamPort,
+		LabelUpstreamNetwork,
+		LabelUpstreamPublished,
+		LabelUpstreamWeight,
+		LabelUpstreamMaxRequests,
+		LabelUpstreamSocket,
+		LabelUpstreamScheme,
+		LabelUpstreamTLSInsecureSkipVerify,
+		LabelUpstreamProtocol,
+		LabelUpstreamGroup,
+		LabelUpstreamGroupActive,
+		LabelUpstreamPriority,
+		LabelUpstreamHost,
+		LabelUpstreamSwarmDial,
+		LabelHealthCheck,
+		LabelHealthCheckPath,
+		LabelHealthCheckInterval,
+		LabelHealthCheckTimeout,
+		LabelHealthCheckExpectedStatus,
+		LabelHealthCheckGRPC,
+		LabelHealthCheckGRPCService,
+		LabelFallback,
+		LabelMirror,
+		LabelCanaryHeader,
+		LabelTLSIssuer,
+		LabelTLSDNSProvider,
+		LabelLBPolicy,
+	}
+	for label := range producers {
+		labels = append(labels, label)
+	}
+
+	m := make(map[string]string, len(labels))
+	for _, label := range labels {
+		m[envName(label)] = label
+	}
+	return m
+}()
+
+func envName(label string) string {
+	name := strings.TrimPrefix(label, defaultLabelPrefix+".")
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, ".", "_"))
+}
+
+// envLabel returns the label of the environment variable. The variables of
+// the header matchers and of the headers.up labels end with the field, whose
+// underscores are dashes.
+func envLabel(name string) (string, bool) {
+	if label, ok := envLabels[name]; ok {
+		return label, true
+	}
+
+	if rest := strings.TrimPrefix(name, envName(LabelMatchNotPrefix)); rest != name {
+		label, ok := envLabel(envName(labelMatchPrefix) + rest)
+		return LabelMatchNotPrefix + strings.TrimPrefix(label, labelMatchPrefix), ok
+	}
+
+	// The header_regexp prefix goes first since it starts with the header one.
+	for _, prefix := range []string{LabelMatchHeaderRegexpPrefix, LabelMatchHeaderPrefix, LabelHeadersUpPrefix} {
+		if field := strings.TrimPrefix(name, envName(prefix)); field != name && field != "" {
+			return prefix + strings.ReplaceAll(field, "_", "-"), true
+		}
+	}
+
+	return "", false
+}
+
+// withEnvLabels returns the labels completed with the environment variables
+// of the labels which are absent. The labels are not read yet, so the
+// variables are set with the configured prefix, if any.
+func withEnvLabels(labels map[string]string, env []string, prefix string) map[string]string {
+	completed := make(map[string]string, len(labels))
+	for key, value := range labels {
+		completed[key] = value
+	}
+
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		if label, ok := envLabel(name); ok {
+			if prefix != "" {
+				label = prefix + strings.TrimPrefix(label, defaultLabelPrefix)
+			}
+			if _, ok := completed[label]; !ok {
+				completed[label] = value
+			}
+		}
+	}
+
+	return completed
+}
+
+// containerEnv returns the environment variables of the container, which are
+// cached since they don't change during the life of the container.
+func (e *endpoint) containerEnv(ctx context.Context, id string) ([]string, error) {
+	if env, ok := e.envs[id]; ok {
+		return env, nil
+	}
+
+	ctx, cancel := e.apiContext(ctx)
+	defer cancel()
+
+	if err := e.throttle(ctx); err != nil {
+		return nil, err
+	}
+
+	container, err := e.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	if container.Config != nil {
+		env = container.Config.Env
+	}
+
+	if e.envs == nil {
+		e.envs = make(map[string][]string)
+	}
+	e.envs[id] = env
+	return env, nil
+}
+
+// forgetEnvs drops the environment variables of the containers which are not
+// listed anymore.
+func (e *endpoint) forgetEnvs() {
+	exists := make(map[string]struct{}, len(e.containers))
+	for _, container := range e.containers {
+		exists[container.ID] = struct{}{}
+	}
+
+	for id := range e.envs {
+		if _, ok := exists[id]; !ok {
+			delete(e.envs, id)
+		}
+	}
+}
+
+// readContainers reads the labels of the listed containers, completed with
+// their environment variables if enabled. The enabled containers listed
+// without network settings are inspected for them.
+func (u *Upstreams) readContainers(ctx context.Context, e *endpoint, containers []types.Container) {
+	for i := range containers {
+		labels := containers[i].Labels
+		if u.EnvLabels {
+			env, err := e.containerEnv(ctx, containers[i].ID)
+			if err != nil {
+				metrics.apiErrors.WithLabelValues(e.name).Inc()
+				u.logger.Error("unable to inspect container environment",
+					zap.String("container_id", containers[i].ID),
+					zap.Error(err),
+				)
+			} else {
+				labels = withEnvLabels(labels, env, u.LabelPrefix)
+			}
+		}
+		containers[i].Labels = u.readLabels(labels, zap.String("container_id", containers[i].ID))
+
+		if containers[i].Labels[LabelEnable] == "true" && !hasNetworkSettings(containers[i]) {
+			err := e.inspectNetworks(ctx, &containers[i])
+			if err != nil {
+				metrics.apiErrors.WithLabelValues(e.name).Inc()
+				u.logger.Error("unable to inspect container networks",
+					zap.String("container_id", containers[i].ID),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
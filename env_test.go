@@ -0,0 +1,97 @@
+package caddy_docker_upstreams
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// TestEnvLabelsCoverLabels checks that every exported label constant of the
+// package, except the prefixes, has an environment variable.
+func TestEnvLabelsCoverLabels(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := 0
+	for _, pkg := range pkgs {
+		for name, file := range pkg.Files {
+			if strings.HasSuffix(name, "_test.go") {
+				continue
+			}
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.CONST {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					spec := spec.(*ast.ValueSpec)
+					for i, ident := range spec.Names {
+						if !strings.HasPrefix(ident.Name, "Label") || strings.HasSuffix(ident.Name, "Prefix") {
+							continue
+						}
+						lit, ok := spec.Values[i].(*ast.BasicLit)
+						if !ok || lit.Kind != token.STRING {
+							continue
+						}
+						label, _ := strconv.Unquote(lit.Value)
+						labels++
+						if got, ok := envLabel(envName(label)); !ok || got != label {
+							t.Errorf("%s: envLabel(%s) = %q, %v, want %q", ident.Name, envName(label), got, ok, label)
+						}
+					}
+				}
+			}
+		}
+	}
+	if labels == 0 {
+		t.Fatal("no label constant found")
+	}
+}
+
+func TestEnvLabelHeaders(t *testing.T) {
+	tests := map[string]string{
+		"CADDY_MATCHERS_HEADER_X_TENANT":        LabelMatchHeaderPrefix + "X-TENANT",
+		"CADDY_MATCHERS_HEADER_REGEXP_X_TENANT": LabelMatchHeaderRegexpPrefix + "X-TENANT",
+		"CADDY_MATCHERS_NOT_HOST":               LabelMatchNotPrefix + "host",
+		"CADDY_HEADERS_UP_X_TENANT":             LabelHeadersUpPrefix + "X-TENANT",
+	}
+	for name, want := range tests {
+		if got, ok := envLabel(name); !ok || got != want {
+			t.Errorf("envLabel(%s) = %q, %v, want %q", name, got, ok, want)
+		}
+	}
+}
+
+// TestEnvOnlyEnabledContainer checks a container enabled by its environment
+// alone is inspected for its networks, and has its environment read with the
+// configured prefix before its labels.
+func TestEnvOnlyEnabledContainer(t *testing.T) {
+	web := types.Container{ID: "web", Names: []string{"/web"}, State: "running"}
+	d := newFakeDaemon(t, web)
+	d.inspect(types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: web.ID, Name: "/web"},
+		Config:            &container.Config{Env: []string{"CADDY_ENABLE=true", "CADDY_UPSTREAM_PORT=80"}},
+		NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"bridge": {IPAddress: "172.17.0.2"},
+		}},
+	})
+
+	for _, prefix := range []string{defaultLabelPrefix, "com.example.caddy"} {
+		t.Run(prefix, func(t *testing.T) {
+			u := d.provisionModule(&Upstreams{LabelPrefix: prefix, EnvLabels: true})
+			waitCandidates(t, u, func(candidates []candidate) bool {
+				return len(candidates) == 1 && candidates[0].address == "172.17.0.2:80"
+			})
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package caddy_docker_upstreams
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+const (
+	EventUpstreamAdded   = "docker.upstream.added"
+	EventUpstreamRemoved = "docker.upstream.removed"
+)
+
+// candidateKey identifies the upstream of a candidate.
+type candidateKey struct {
+	endpoint, id, upstreamName, address string
+}
+
+// diffCandidates returns the candidates which are new in updated, and the
+// previous ones which are not in updated anymore.
+func diffCandidates(previous, updated []candidate) (added, removed []candidate) {
+	keys := make(map[candidateKey]int, len(previous))
+	for _, c := range previous {
+		keys[candidateKey{c.endpoint, c.id, c.upstreamName, c.address}]++
+	}
+	for _, c := range updated {
+		k := candidateKey{c.endpoint, c.id, c.upstreamName, c.address}
+		if keys[k] == 0 {
+			added = append(added, c)
+			continue
+		}
+		keys[k]--
+	}
+
+	for _, c := range previous {
+		k := candidateKey{c.endpoint, c.id, c.upstreamName, c.address}
+		if keys[k] > 0 {
+			removed = append(removed, c)
+			keys[k]--
+		}
+	}
+	return added, removed
+}
+
+// emitEvents emits an event through the events app for every added and
+// removed candidate.
+func (u *Upstreams) emitEvents(events *caddyevents.App, previous, updated []candidate) {
+	added, removed := diffCandidates(previous, updated)
+	for _, c := range added {
+		events.Emit(u.ctx, EventUpstreamAdded, eventData(c))
+	}
+	for _, c := range removed {
+		events.Emit(u.ctx, EventUpstreamRemoved, eventData(c))
+	}
+}
+
+func eventData(c candidate) map[string]any {
+	return map[string]any{
+		"instance":       c.instance,
+		"endpoint":       c.endpoint,
+		"container_id":   c.id,
+		"container_name": c.name,
+		"upstream":       c.upstreamName,
+		"address":        c.address,
+		"group":          c.deployGroup,
+	}
+}
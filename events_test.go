@@ -0,0 +1,269 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+)
+
+// fakeDaemon serves the ping, container list, container inspect and events
+// endpoints of the docker API, the events being sent with send.
+type fakeDaemon struct {
+	t      *testing.T
+	srv    *httptest.Server
+	events chan events.Message
+
+	mu         sync.Mutex
+	containers []types.Container
+	// inspected are the inspected containers by id.
+	inspected map[string]types.ContainerJSON
+}
+
+var (
+	apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+	inspectPath      = regexp.MustCompile(`^/containers/([^/]+)/json$`)
+)
+
+func newFakeDaemon(t *testing.T, containers ...types.Container) *fakeDaemon {
+	d := &fakeDaemon{t: t, events: make(chan events.Message), containers: containers}
+	d.srv = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.srv.Close)
+	return d
+}
+
+func (d *fakeDaemon) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("API-Version", "1.41")
+	switch apiVersionPrefix.ReplaceAllString(r.URL.Path, "") {
+	case "/_ping":
+		_, _ = w.Write([]byte("OK"))
+	case "/containers/json":
+		args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.mu.Lock()
+		listed := make([]types.Container, 0, len(d.containers))
+		for _, c := range d.containers {
+			if (!args.Contains("id") || args.ExactMatch("id", c.ID)) && args.MatchKVList("label", c.Labels) {
+				listed = append(listed, c)
+			}
+		}
+		d.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(listed)
+	case "/events":
+		args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case message := <-d.events:
+				// The events are filtered like the daemon does.
+				if (args.Contains("type") && !args.ExactMatch("type", string(message.Type))) ||
+					(args.Contains("event") && !args.ExactMatch("event", message.Action)) {
+					continue
+				}
+				_ = enc.Encode(message)
+				w.(http.Flusher).Flush()
+			}
+		}
+	default:
+		if m := inspectPath.FindStringSubmatch(apiVersionPrefix.ReplaceAllString(r.URL.Path, "")); m != nil {
+			d.mu.Lock()
+			container, ok := d.inspected[m[1]]
+			d.mu.Unlock()
+			if ok {
+				_ = json.NewEncoder(w).Encode(container)
+				return
+			}
+		}
+		d.t.Logf("fake daemon: unexpected request %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}
+}
+
+// set replaces the listed containers.
+func (d *fakeDaemon) set(containers ...types.Container) {
+	d.mu.Lock()
+	d.containers = containers
+	d.mu.Unlock()
+}
+
+// inspect sets the inspected container.
+func (d *fakeDaemon) inspect(container types.ContainerJSON) {
+	d.mu.Lock()
+	if d.inspected == nil {
+		d.inspected = make(map[string]types.ContainerJSON)
+	}
+	d.inspected[container.ID] = container
+	d.mu.Unlock()
+}
+
+func (d *fakeDaemon) send(message events.Message) {
+	select {
+	case d.events <- message:
+	case <-time.After(5 * time.Second):
+		d.t.Fatalf("event %s %s not received", message.Type, message.Action)
+	}
+}
+
+// provision provisions a module watching the daemon, whose debounced
+// refreshes only happen after the test.
+func (d *fakeDaemon) provision(debounce time.Duration) *Upstreams {
+	d.t.Helper()
+	// The instance doesn't prefix the labels.
+	return d.provisionModule(&Upstreams{LabelPrefix: defaultLabelPrefix, Debounce: caddy.Duration(debounce)})
+}
+
+// provisionModule provisions the module u watching the daemon.
+func (d *fakeDaemon) provisionModule(u *Upstreams) *Upstreams {
+	d.t.Helper()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	d.t.Cleanup(cancel)
+
+	u.Host = "tcp://" + strings.TrimPrefix(d.srv.URL, "http://")
+	u.APIVersion = "1.41"
+	u.Instance = "fake-" + d.t.Name()
+	if err := u.Provision(ctx); err != nil {
+		d.t.Fatalf("unable to provision: %v", err)
+	}
+	d.t.Cleanup(func() {
+		_ = u.Cleanup()
+		instancesMu.Lock()
+		delete(instances, u.instance.name)
+		instancesMu.Unlock()
+	})
+	return u
+}
+
+func fakeContainer(id, ip string, labels map[string]string) types.Container {
+	all := map[string]string{LabelEnable: "true", LabelUpstreamPort: "80"}
+	for key, value := range labels {
+		all[key] = value
+	}
+	return types.Container{
+		ID:     id,
+		Names:  []string{"/" + id},
+		State:  "running",
+		Labels: all,
+		NetworkSettings: &types.SummaryNetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"bridge": {IPAddress: ip},
+		}},
+	}
+}
+
+// waitCandidates waits until the candidates of the module satisfy ok.
+func waitCandidates(t *testing.T, u *Upstreams, ok func([]candidate) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok(u.instance.loadSnapshot().candidates) {
+		if time.Now().After(deadline) {
+			t.Fatalf("candidates = %v", u.instance.loadSnapshot().candidates)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasAddress(address string) func([]candidate) bool {
+	return func(candidates []candidate) bool {
+		for _, c := range candidates {
+			if c.address == address {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestKillEventRemovesCandidate(t *testing.T) {
+	web := fakeContainer("web", "172.17.0.2", nil)
+	d := newFakeDaemon(t, web)
+	// The debounced refreshes don't happen during the test.
+	u := d.provision(time.Hour)
+	waitCandidates(t, u, hasAddress("172.17.0.2:80"))
+
+	actor := func(signal string) events.Actor {
+		return events.Actor{ID: web.ID, Attributes: map[string]string{"signal": signal}}
+	}
+
+	// A reload signal keeps the container.
+	d.send(events.Message{Type: events.ContainerEventType, Action: "kill", Actor: actor("1")})
+	time.Sleep(100 * time.Millisecond)
+	waitCandidates(t, u, hasAddress("172.17.0.2:80"))
+
+	// SIGTERM removes it right away, while it is still running to drain
+	// the requests it received.
+	d.send(events.Message{Type: events.ContainerEventType, Action: "kill", Actor: actor("15")})
+	waitCandidates(t, u, func(candidates []candidate) bool { return len(candidates) == 0 })
+
+	web.State = "exited"
+	d.set(web)
+	d.send(events.Message{Type: events.ContainerEventType, Action: "die", Actor: actor("")})
+	time.Sleep(100 * time.Millisecond)
+	waitCandidates(t, u, func(candidates []candidate) bool { return len(candidates) == 0 })
+}
+
+func TestUpdateEventRefreshesCandidate(t *testing.T) {
+	d := newFakeDaemon(t, fakeContainer("web", "172.17.0.2", nil))
+	u := d.provision(0)
+	waitCandidates(t, u, hasAddress("172.17.0.2:80"))
+
+	web := fakeContainer("web", "172.17.0.2", map[string]string{LabelUpstreamPort: "8080"})
+	d.set(web)
+	d.send(events.Message{Type: events.ContainerEventType, Action: "update", Actor: events.Actor{ID: web.ID}})
+	waitCandidates(t, u, hasAddress("172.17.0.2:8080"))
+}
+
+func TestEventFilters(t *testing.T) {
+	for _, mode := range []string{"", ModeSwarm} {
+		args := (&Upstreams{Mode: mode}).eventFilters()
+		if args.Contains("event") {
+			t.Errorf("mode %q: event filters %v filter the actions", mode, args)
+		}
+		if !args.ExactMatch("type", string(events.ContainerEventType)) {
+			t.Errorf("mode %q: event filters %v drop the container events", mode, args)
+		}
+		if service := args.ExactMatch("type", string(events.ServiceEventType)); service != (mode == ModeSwarm) {
+			t.Errorf("mode %q: event filters %v, want service events %v", mode, args, mode == ModeSwarm)
+		}
+	}
+}
+
+func TestRelevantEvent(t *testing.T) {
+	tests := []struct {
+		message  events.Message
+		relevant bool
+	}{
+		{message: events.Message{Type: events.ContainerEventType, Action: "update"}, relevant: true},
+		{message: events.Message{Type: events.ServiceEventType, Action: "update"}, relevant: true},
+		{message: events.Message{Type: events.ContainerEventType, Action: "start"}, relevant: true},
+		{message: events.Message{Type: events.ContainerEventType, Action: "exec_start: sh"}, relevant: false},
+		{message: events.Message{Type: events.NetworkEventType, Action: "connect"}, relevant: false},
+	}
+
+	for _, tt := range tests {
+		if got := relevantEvent(tt.message); got != tt.relevant {
+			t.Errorf("relevantEvent(%s %s) = %v, want %v", tt.message.Type, tt.message.Action, got, tt.relevant)
+		}
+	}
+}
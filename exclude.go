@@ -0,0 +1,54 @@
+package caddy_docker_upstreams
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// globs are compiled glob patterns, in which `*` matches any characters,
+// including `/`, and `?` a single one.
+type globs []*regexp.Regexp
+
+// compileGlobs compiles the glob patterns.
+func compileGlobs(patterns []string) globs {
+	compiled := make(globs, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, `.*`)
+		expr = strings.ReplaceAll(expr, `\?`, `.`)
+		compiled = append(compiled, regexp.MustCompile("^"+expr+"$"))
+	}
+	return compiled
+}
+
+// match reports whether the value matches any of the patterns.
+func (g globs) match(value string) bool {
+	for _, re := range g {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeGlobs are the compiled include and exclude patterns of the module.
+type excludeGlobs struct {
+	includeName, includeImage globs
+	excludeName, excludeImage globs
+}
+
+// excluded reports whether the container is left out by its name or image,
+// it is discovered if it matches the include patterns, when set, and none
+// of the exclude patterns.
+func (u *Upstreams) excluded(container types.Container) bool {
+	name := containerName(container)
+	if len(u.globs.includeName) > 0 && !u.globs.includeName.match(name) {
+		return true
+	}
+	if len(u.globs.includeImage) > 0 && !u.globs.includeImage.match(container.Image) {
+		return true
+	}
+	return u.globs.excludeName.match(name) || u.globs.excludeImage.match(container.Image)
+}
@@ -0,0 +1,56 @@
+package caddy_docker_upstreams
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestGlobs(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		value    string
+		matches  bool
+	}{
+		{patterns: []string{"web"}, value: "web", matches: true},
+		{patterns: []string{"web"}, value: "web-1", matches: false},
+		{patterns: []string{"*-migrate"}, value: "shop-migrate", matches: true},
+		{patterns: []string{"*-migrate"}, value: "shop-migrate-1", matches: false},
+		{patterns: []string{"web-?"}, value: "web-1", matches: true},
+		{patterns: []string{"web-?"}, value: "web-10", matches: false},
+		// `*` matches `/`, unlike path.Match.
+		{patterns: []string{"ghcr.io/*"}, value: "ghcr.io/acme/web:1.0", matches: true},
+		// The other regexp characters are literal.
+		{patterns: []string{"web.1"}, value: "webx1", matches: false},
+		{patterns: []string{"a", "b*"}, value: "bc", matches: true},
+		{value: "web", matches: false},
+	}
+
+	for _, tt := range tests {
+		if got := compileGlobs(tt.patterns).match(tt.value); got != tt.matches {
+			t.Errorf("%q match %q = %v, want %v", tt.patterns, tt.value, got, tt.matches)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	u := &Upstreams{globs: excludeGlobs{
+		includeImage: compileGlobs([]string{"acme/*"}),
+		excludeName:  compileGlobs([]string{"*-migrate"}),
+	}}
+
+	tests := []struct {
+		name, image string
+		excluded    bool
+	}{
+		{name: "web", image: "acme/web:1.0", excluded: false},
+		{name: "web-migrate", image: "acme/web:1.0", excluded: true},
+		{name: "db", image: "postgres:16", excluded: true},
+	}
+	for _, tt := range tests {
+		container := types.Container{Names: []string{"/" + tt.name}, Image: tt.image}
+		if got := u.excluded(container); got != tt.excluded {
+			t.Errorf("excluded(%s, %s) = %v, want %v", tt.name, tt.image, got, tt.excluded)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package caddy_docker_upstreams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	LabelUpstreamGroup       = "com.caddyserver.http.upstream.group"
+	LabelUpstreamGroupActive = "com.caddyserver.http.upstream.group.active"
+)
+
+var (
+	// groupOverrides holds the deployment groups activated or deactivated
+	// with the admin API, which take precedence over the labels.
+	groupOverrides   = make(map[string]bool)
+	groupOverridesMu sync.RWMutex
+)
+
+// deploymentGroups returns whether the deployment groups of the candidates
+// are active by their labels, a group is active if any of its containers has
+// the group.active label set to true.
+func deploymentGroups(updated []candidate) map[string]bool {
+	groups := make(map[string]bool)
+	for _, c := range updated {
+		if c.deployGroup != "" {
+			groups[c.deployGroup] = groups[c.deployGroup] || c.labels[LabelUpstreamGroupActive] == "true"
+		}
+	}
+	return groups
+}
+
+// groupActive reports whether the deployment group receives traffic, labeled
+// are the groups of the snapshot. The candidates without group always do.
+func groupActive(labeled map[string]bool, group string) bool {
+	if group == "" {
+		return true
+	}
+
+	groupOverridesMu.RLock()
+	active, ok := groupOverrides[group]
+	groupOverridesMu.RUnlock()
+	if ok {
+		return active
+	}
+
+	return labeled[group]
+}
+
+// handleGroups writes the deployment groups and whether they are active, and
+// activates or deactivates them all at once.
+func (a *adminAPI) handleGroups(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var overrides map[string]bool
+		err := json.NewDecoder(r.Body).Decode(&overrides)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding groups: %w", err),
+			}
+		}
+
+		groupOverridesMu.Lock()
+		for group, active := range overrides {
+			groupOverrides[group] = active
+		}
+		groupOverridesMu.Unlock()
+	case http.MethodDelete:
+		// Go back to the labels.
+		groupOverridesMu.Lock()
+		groupOverrides = make(map[string]bool)
+		groupOverridesMu.Unlock()
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	groups := make(map[string]bool)
+	for _, s := range loadSnapshots() {
+		for group := range s.groups {
+			groups[group] = groups[group] || groupActive(s.groups, group)
+		}
+	}
+
+	groupOverridesMu.RLock()
+	for group, active := range groupOverrides {
+		groups[group] = active
+	}
+	groupOverridesMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(groups)
+}
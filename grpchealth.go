@@ -0,0 +1,52 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	LabelHealthCheckGRPC        = "com.caddyserver.http.healthcheck.grpc"
+	LabelHealthCheckGRPCService = "com.caddyserver.http.healthcheck.grpc.service"
+)
+
+// grpcHealthCheck reports whether the candidate is checked with the gRPC
+// health protocol.
+func grpcHealthCheck(c candidate) bool {
+	return c.labels[LabelHealthCheckGRPC] == "true"
+}
+
+// doGRPC calls the Check method of the grpc.health.v1 service of the
+// candidate, for the service of the grpc.service label, or the server as a
+// whole if absent. It fails unless the status is SERVING.
+func (check healthCheck) doGRPC(ctx context.Context) error {
+	creds := insecure.NewCredentials()
+	if check.tls {
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: check.insecure})
+	}
+
+	address := check.address
+	if check.network == "unix" {
+		address = "unix:" + address
+	}
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(creds), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: check.service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
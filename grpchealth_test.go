@@ -0,0 +1,54 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGRPCHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	status := health.NewServer()
+	healthpb.RegisterHealthServer(server, status)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	status.SetServingStatus("app.Serving", healthpb.HealthCheckResponse_SERVING)
+	status.SetServingStatus("app.Draining", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	tests := []struct {
+		service string
+		ok      bool
+	}{
+		{service: "", ok: true},
+		{service: "app.Serving", ok: true},
+		{service: "app.Draining", ok: false},
+		{service: "app.Unknown", ok: false},
+	}
+
+	for _, tt := range tests {
+		labels := map[string]string{LabelHealthCheckGRPC: "true"}
+		if tt.service != "" {
+			labels[LabelHealthCheckGRPCService] = tt.service
+		}
+		c := candidate{address: ln.Addr().String(), upstream: &reverseproxy.Upstream{Dial: ln.Addr().String()}, labels: labels}
+
+		check, ok := newHealthCheck(c)
+		if !ok || !check.grpc {
+			t.Fatalf("newHealthCheck() = %v, %v, want a gRPC check", check, ok)
+		}
+		err := check.do(context.Background())
+		if (err == nil) != tt.ok {
+			t.Errorf("service %q: do() = %v, want ok %v", tt.service, err, tt.ok)
+		}
+	}
+}
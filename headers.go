@@ -0,0 +1,76 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const LabelUpstreamHost = "com.caddyserver.http.upstream.host"
+
+const (
+	// UpstreamHostPreserve proxies the Host of the client request, the
+	// default.
+	UpstreamHostPreserve = "preserve"
+	// UpstreamHostUpstream rewrites the Host to the dial address of the
+	// upstream.
+	UpstreamHostUpstream = "upstream"
+)
+
+// The request header follows the prefix, e.g.
+// com.caddyserver.http.headers.up.X-Container.
+const LabelHeadersUpPrefix = "com.caddyserver.http.headers.up."
+
+// headerLabels returns the request headers declared by the labels, by
+// canonical name. An empty value removes the header.
+func headerLabels(labels map[string]string) map[string]string {
+	var headers map[string]string
+	for key, value := range labels {
+		if name := strings.TrimPrefix(key, LabelHeadersUpPrefix); name != key && name != "" {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return headers
+}
+
+// upstreamHost returns the Host of the requests proxied to c by the host
+// label, empty to preserve the Host of the client request.
+func (c candidate) upstreamHost() string {
+	switch c.host {
+	case "", UpstreamHostPreserve:
+		return ""
+	case UpstreamHostUpstream:
+		if strings.HasPrefix(c.upstream.Dial, "unix/") {
+			return ""
+		}
+		return c.address
+	default:
+		return c.host
+	}
+}
+
+// setHeaders modifies the headers and the Host of the request proxied to c,
+// the request placeholders left in the values are replaced.
+func (c candidate) setHeaders(r *http.Request, repl *caddy.Replacer) {
+	for name, value := range c.headers {
+		if repl != nil {
+			value = repl.ReplaceKnown(value, "")
+		}
+		if value == "" {
+			r.Header.Del(name)
+			continue
+		}
+		r.Header.Set(name, value)
+	}
+
+	if host := c.upstreamHost(); host != "" {
+		if repl != nil {
+			host = repl.ReplaceKnown(host, "")
+		}
+		r.Host = host
+	}
+}
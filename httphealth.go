@@ -0,0 +1,273 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	LabelHealthCheckPath           = "com.caddyserver.http.healthcheck.path"
+	LabelHealthCheckInterval       = "com.caddyserver.http.healthcheck.interval"
+	LabelHealthCheckTimeout        = "com.caddyserver.http.healthcheck.timeout"
+	LabelHealthCheckExpectedStatus = "com.caddyserver.http.healthcheck.expected_status"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+
+	// healthCheckTick is the resolution of the health check intervals.
+	healthCheckTick = time.Second
+)
+
+// healthCheck is the http or gRPC health check of a candidate declared by
+// its healthcheck labels.
+type healthCheck struct {
+	network, address, name string
+	host                   string
+	url                    string
+	interval, timeout      time.Duration
+	expectedStatus         string
+	tls, insecure          bool
+	// grpc checks the candidate with the gRPC health protocol, for the
+	// service.
+	grpc    bool
+	service string
+}
+
+// checkHealth checks the candidates of the instance having a health check at
+// their interval, and withholds the ones failing it until it passes again.
+func (i *instance) checkHealth(ctx context.Context) {
+	ticker := time.NewTicker(healthCheckTick)
+	defer ticker.Stop()
+
+	next := make(map[string]time.Time)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checks := healthChecks(i.loadSnapshot())
+		now := time.Now()
+
+		var wg sync.WaitGroup
+		due := make([]healthCheck, 0, len(checks))
+		for _, check := range checks {
+			if t, ok := next[check.address]; ok && now.Before(t) {
+				continue
+			}
+			next[check.address] = now.Add(check.interval)
+			due = append(due, check)
+		}
+		errs := make([]error, len(due))
+		for j, check := range due {
+			wg.Add(1)
+			go func(j int, check healthCheck) {
+				defer wg.Done()
+				errs[j] = check.do(ctx)
+			}(j, check)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		current := make(map[string]struct{}, len(checks))
+		for _, check := range checks {
+			current[check.address] = struct{}{}
+		}
+
+		_, _, logger := i.settings()
+		i.checksMu.Lock()
+		unhealthy := i.unhealthy
+		for j, check := range due {
+			_, wasUnhealthy := unhealthy[check.address]
+			switch {
+			case errs[j] == nil && wasUnhealthy:
+				delete(unhealthy, check.address)
+				logger.Info("upstream passes health check again",
+					zap.String("container_name", check.name),
+					zap.String("address", check.address),
+				)
+			case errs[j] != nil && !wasUnhealthy:
+				unhealthy[check.address] = struct{}{}
+				logger.Warn("withhold upstream failing health check",
+					zap.String("container_name", check.name),
+					zap.String("address", check.address),
+					zap.Error(errs[j]),
+				)
+			}
+		}
+
+		// Forget the candidates which are gone.
+		for address := range unhealthy {
+			if _, ok := current[address]; !ok {
+				delete(unhealthy, address)
+			}
+		}
+		i.checksMu.Unlock()
+		for address := range next {
+			if _, ok := current[address]; !ok {
+				delete(next, address)
+			}
+		}
+	}
+}
+
+// do requests the health check path, which fails unless the response status
+// is the expected one, or calls the gRPC health service.
+func (check healthCheck) do(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+
+	if check.grpc {
+		return check.doGRPC(ctx)
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, check.network, check.address)
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: check.insecure},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.url, nil)
+	if err != nil {
+		return err
+	}
+	if check.host != "" {
+		req.Host = check.host
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+
+	if !statusMatches(check.expectedStatus, resp.StatusCode) {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// healthChecks returns the http health checks of the distinct addresses of
+// the candidates of the snapshot.
+func healthChecks(s *snapshot) []healthCheck {
+	var checks []healthCheck
+	seen := make(map[string]struct{})
+	for _, c := range s.candidates {
+		if _, ok := seen[c.address]; ok {
+			continue
+		}
+		if check, ok := newHealthCheck(c); ok {
+			seen[c.address] = struct{}{}
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+// hasHealthChecks reports whether a candidate of the snapshot has a health
+// check.
+func hasHealthChecks(s *snapshot) bool {
+	for _, c := range s.candidates {
+		if _, ok := c.labels[LabelHealthCheckPath]; ok || grpcHealthCheck(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// newHealthCheck returns the health check of the candidate, if it has the
+// path label or the grpc label.
+func newHealthCheck(c candidate) (healthCheck, bool) {
+	path, ok := c.labels[LabelHealthCheckPath]
+	if !ok && !grpcHealthCheck(c) {
+		return healthCheck{}, false
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	check := healthCheck{
+		network:        "tcp",
+		address:        c.address,
+		name:           c.name,
+		host:           c.upstreamHost(),
+		interval:       labelDuration(c.labels, LabelHealthCheckInterval, defaultHealthCheckInterval),
+		timeout:        labelDuration(c.labels, LabelHealthCheckTimeout, defaultHealthCheckTimeout),
+		expectedStatus: c.labels[LabelHealthCheckExpectedStatus],
+		tls:            c.scheme == "https",
+		insecure:       c.insecure,
+		grpc:           grpcHealthCheck(c),
+		service:        c.labels[LabelHealthCheckGRPCService],
+	}
+	if strings.HasPrefix(c.upstream.Dial, "unix/") {
+		check.network = "unix"
+	}
+
+	scheme, host := "http", c.address
+	if check.tls {
+		scheme = "https"
+	}
+	if check.network == "unix" {
+		host = "localhost"
+	}
+	check.url = scheme + "://" + host + path
+	return check, true
+}
+
+// labelDuration returns the positive duration of the label, or fallback.
+func labelDuration(labels map[string]string, key string, fallback time.Duration) time.Duration {
+	if value, ok := labels[key]; ok {
+		if d, err := caddy.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
+
+// statusMatches reports whether the status code is the expected one, either
+// a code like 200 or a class like 2xx. Any 2xx or 3xx status is expected by
+// default.
+func statusMatches(expected string, code int) bool {
+	switch {
+	case expected == "":
+		return code >= 200 && code < 400
+	case len(expected) == 3 && strings.HasSuffix(expected, "xx"):
+		return strconv.Itoa(code/100) == expected[:1]
+	default:
+		return strconv.Itoa(code) == expected
+	}
+}
+
+// checkExpectedStatus validates the expected_status label.
+func checkExpectedStatus(value string) error {
+	if len(value) == 3 && strings.HasSuffix(value, "xx") && value[0] >= '1' && value[0] <= '5' {
+		return nil
+	}
+	if code, err := strconv.Atoi(value); err == nil && code >= 100 && code <= 599 {
+		return nil
+	}
+	return fmt.Errorf("invalid status '%s', expected a code like 200 or a class like 2xx", value)
+}
@@ -0,0 +1,117 @@
+package caddy_docker_upstreams
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// candidateIndex holds the positions of the candidates by the exact hosts of
+// their host matcher, so the other candidates aren't matched against the
+// requests of an indexed host.
+type candidateIndex struct {
+	byHost map[string][]int
+	// unindexed are the candidates without host matcher, or whose hosts have
+	// wildcards or placeholders, which are matched against every request.
+	unindexed []int
+}
+
+// indexHosts returns the index of the candidates.
+func indexHosts(updated []candidate) candidateIndex {
+	index := candidateIndex{byHost: make(map[string][]int)}
+	for i, c := range updated {
+		hosts, ok := exactHosts(c.matchers)
+		if !ok {
+			index.unindexed = append(index.unindexed, i)
+			continue
+		}
+		for _, host := range hosts {
+			index.byHost[host] = append(index.byHost[host], i)
+		}
+	}
+	return index
+}
+
+// exactHosts returns the lowercased hosts of the host matchers of the sets,
+// and false if a set has none, or if any of their hosts isn't exact.
+func exactHosts(sets caddyhttp.MatcherSets) ([]string, bool) {
+	if len(sets) == 0 {
+		return nil, false
+	}
+
+	var hosts []string
+	seen := make(map[string]struct{})
+	for _, set := range sets {
+		setHosts, ok := exactSetHosts(set)
+		if !ok {
+			return nil, false
+		}
+		for _, host := range setHosts {
+			if _, ok := seen[host]; !ok {
+				seen[host] = struct{}{}
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts, true
+}
+
+// exactSetHosts returns the lowercased hosts of the host matcher of the set,
+// and false if it has none, or if any of its hosts isn't exact.
+func exactSetHosts(matchers caddyhttp.MatcherSet) ([]string, bool) {
+	for _, matcher := range matchers {
+		match, ok := matcher.(caddyhttp.MatchHost)
+		if !ok {
+			continue
+		}
+
+		hosts := make([]string, 0, len(match))
+		seen := make(map[string]struct{}, len(match))
+		for _, host := range match {
+			if strings.ContainsAny(host, "*{") {
+				return nil, false
+			}
+			host = strings.ToLower(host)
+			if _, ok := seen[host]; !ok {
+				seen[host] = struct{}{}
+				hosts = append(hosts, host)
+			}
+		}
+		return hosts, true
+	}
+	return nil, false
+}
+
+// lookup returns the positions of the candidates which may match the
+// request, in order.
+func (index candidateIndex) lookup(r *http.Request) []int {
+	// Like the host matcher.
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+	}
+
+	indexed := index.byHost[strings.ToLower(host)]
+	if len(indexed) == 0 {
+		return index.unindexed
+	}
+	if len(index.unindexed) == 0 {
+		return indexed
+	}
+
+	merged := make([]int, 0, len(indexed)+len(index.unindexed))
+	i, j := 0, 0
+	for i < len(indexed) && j < len(index.unindexed) {
+		if indexed[i] < index.unindexed[j] {
+			merged = append(merged, indexed[i])
+			i++
+		} else {
+			merged = append(merged, index.unindexed[j])
+			j++
+		}
+	}
+	merged = append(merged, indexed[i:]...)
+	return append(merged, index.unindexed[j:]...)
+}
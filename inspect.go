@@ -0,0 +1,54 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types"
+)
+
+// isHostNetwork reports whether the container shares the network of the
+// host, so it has no ip address of its own.
+func isHostNetwork(container types.Container) bool {
+	return container.HostConfig.NetworkMode == "host"
+}
+
+// hasNetworkSettings reports whether the listed container has a network with
+// an ip address, or is in the host network.
+func hasNetworkSettings(container types.Container) bool {
+	if isHostNetwork(container) {
+		return true
+	}
+	if container.NetworkSettings == nil {
+		return false
+	}
+	for _, settings := range container.NetworkSettings.Networks {
+		if settings != nil && (settings.IPAddress != "" || settings.GlobalIPv6Address != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectNetworks completes the network settings of the container, which the
+// list API may return empty for the containers just created.
+func (e *endpoint) inspectNetworks(ctx context.Context, container *types.Container) error {
+	ctx, cancel := e.apiContext(ctx)
+	defer cancel()
+
+	if err := e.throttle(ctx); err != nil {
+		return err
+	}
+
+	inspected, err := e.cli.ContainerInspect(ctx, container.ID)
+	if err != nil {
+		return err
+	}
+
+	if inspected.HostConfig != nil && container.HostConfig.NetworkMode == "" {
+		container.HostConfig.NetworkMode = string(inspected.HostConfig.NetworkMode)
+	}
+	if inspected.NetworkSettings != nil && len(inspected.NetworkSettings.Networks) > 0 {
+		container.NetworkSettings = &types.SummaryNetworkSettings{Networks: inspected.NetworkSettings.Networks}
+	}
+	return nil
+}
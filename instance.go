@@ -0,0 +1,187 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// instance holds the state of the modules having the same Instance name,
+// which carries over from one config load to the next.
+type instance struct {
+	name string
+	// current is the snapshot of the last refresh, swapped by the
+	// refreshes.
+	current atomic.Pointer[snapshot]
+	// policies holds the selection policies of the candidate groups, they
+	// are kept across refreshes so stateful policies like round_robin carry
+	// on. Guarded by refreshMu.
+	policies map[string]*lbPolicy
+
+	// mu guards the probes and health checks shared by the modules of the
+	// instance, which run while a module holds a reference, see acquire.
+	mu   sync.Mutex
+	refs int
+	// probeInterval, probeFailures and logger are the settings of the
+	// module acquired last.
+	probeInterval time.Duration
+	probeFailures int
+	logger        *zap.Logger
+	stopProbe     context.CancelFunc
+	stopHealth    context.CancelFunc
+
+	// checksMu guards quarantined and unhealthy, the dial addresses of the
+	// candidates failing the probes and the health checks, which are not
+	// provided as upstreams.
+	checksMu    sync.RWMutex
+	quarantined map[string]struct{}
+	unhealthy   map[string]struct{}
+}
+
+var (
+	instances   = make(map[string]*instance)
+	instancesMu sync.Mutex
+)
+
+// getInstance returns the instance of the name, created on first use.
+func getInstance(name string) *instance {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+
+	i, ok := instances[name]
+	if !ok {
+		i = &instance{
+			name:        name,
+			policies:    make(map[string]*lbPolicy),
+			quarantined: make(map[string]struct{}),
+			unhealthy:   make(map[string]struct{}),
+		}
+		instances[name] = i
+	}
+	return i
+}
+
+// loadSnapshot returns the snapshot of the last refresh, which is empty
+// before the first one.
+func (i *instance) loadSnapshot() *snapshot {
+	if s := i.current.Load(); s != nil {
+		return s
+	}
+	return &snapshot{}
+}
+
+// loadSnapshots returns the snapshots of every instance, ordered by the
+// instance names.
+func loadSnapshots() []*snapshot {
+	instancesMu.Lock()
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshots := make([]*snapshot, 0, len(names))
+	for _, name := range names {
+		snapshots = append(snapshots, instances[name].loadSnapshot())
+	}
+	instancesMu.Unlock()
+
+	return snapshots
+}
+
+// acquire references the instance for the module, and starts the probes and
+// the health checks of its candidates if they are not running. The settings
+// of the module replace the ones of the modules acquired before, e.g. on a
+// config reload.
+func (i *instance) acquire(u *Upstreams) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.refs++
+	i.probeInterval = time.Duration(u.ProbeInterval)
+	i.probeFailures = u.ProbeFailures
+	i.logger = u.logger
+
+	switch {
+	case i.probeInterval > 0 && i.stopProbe == nil:
+		var ctx context.Context
+		ctx, i.stopProbe = context.WithCancel(context.Background())
+		go i.probe(ctx)
+	case i.probeInterval == 0 && i.stopProbe != nil:
+		i.stopProbe()
+		i.stopProbe = nil
+	}
+	if hasHealthChecks(i.loadSnapshot()) {
+		i.startHealthChecksLocked()
+	}
+}
+
+// release dereferences the instance, and stops its probes and health checks
+// once no module references it.
+func (i *instance) release() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.refs--
+	if i.refs > 0 {
+		return
+	}
+	for _, stop := range []context.CancelFunc{i.stopProbe, i.stopHealth} {
+		if stop != nil {
+			stop()
+		}
+	}
+	i.stopProbe, i.stopHealth = nil, nil
+
+	i.checksMu.Lock()
+	i.quarantined = make(map[string]struct{})
+	i.unhealthy = make(map[string]struct{})
+	i.checksMu.Unlock()
+	metrics.quarantined.DeleteLabelValues(i.name)
+}
+
+// startHealthChecks starts the health checks of the candidates if they are
+// not running, once a candidate has healthcheck labels.
+func (i *instance) startHealthChecks() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.startHealthChecksLocked()
+}
+
+func (i *instance) startHealthChecksLocked() {
+	if i.refs == 0 || i.stopHealth != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, i.stopHealth = context.WithCancel(context.Background())
+	go i.checkHealth(ctx)
+}
+
+// settings returns the settings of the probes and health checks.
+func (i *instance) settings() (time.Duration, int, *zap.Logger) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.probeInterval, i.probeFailures, i.logger
+}
+
+func (i *instance) isQuarantined(address string) bool {
+	i.checksMu.RLock()
+	defer i.checksMu.RUnlock()
+
+	_, ok := i.quarantined[address]
+	return ok
+}
+
+func (i *instance) isUnhealthy(address string) bool {
+	i.checksMu.RLock()
+	defer i.checksMu.RUnlock()
+
+	_, ok := i.unhealthy[address]
+	return ok
+}
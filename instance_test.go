@@ -0,0 +1,77 @@
+package caddy_docker_upstreams
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestInstanceAcquireRelease(t *testing.T) {
+	i := getInstance("test-acquire-release")
+	t.Cleanup(func() {
+		instancesMu.Lock()
+		delete(instances, i.name)
+		instancesMu.Unlock()
+	})
+
+	first := &Upstreams{ProbeInterval: caddy.Duration(time.Hour), ProbeFailures: 3, logger: zap.NewNop()}
+	second := &Upstreams{ProbeInterval: caddy.Duration(time.Minute), ProbeFailures: 5, logger: zap.NewNop()}
+
+	i.acquire(first)
+	stop := i.stopProbe
+	if stop == nil {
+		t.Fatal("acquire didn't start the probes")
+	}
+
+	i.acquire(second)
+	if i.refs != 2 {
+		t.Errorf("refs = %d, want 2", i.refs)
+	}
+	interval, failures, _ := i.settings()
+	if interval != time.Minute || failures != 5 {
+		t.Errorf("settings = %v, %d, want the ones of the last module", interval, failures)
+	}
+
+	i.checksMu.Lock()
+	i.quarantined["10.0.0.1:80"] = struct{}{}
+	i.checksMu.Unlock()
+
+	i.release()
+	if i.stopProbe == nil || !i.isQuarantined("10.0.0.1:80") {
+		t.Error("release of one module stopped the probes of the other")
+	}
+
+	i.release()
+	if i.stopProbe != nil || i.stopHealth != nil {
+		t.Error("release of the last module didn't stop the probes")
+	}
+	if i.isQuarantined("10.0.0.1:80") {
+		t.Error("release of the last module kept the quarantine")
+	}
+}
+
+func TestInstanceHealthChecksStartOnDemand(t *testing.T) {
+	i := getInstance("test-health-on-demand")
+	t.Cleanup(func() {
+		i.release()
+		instancesMu.Lock()
+		delete(instances, i.name)
+		instancesMu.Unlock()
+	})
+
+	i.acquire(&Upstreams{logger: zap.NewNop()})
+	if i.stopProbe != nil || i.stopHealth != nil {
+		t.Fatal("acquire started checks without probe_interval nor healthcheck labels")
+	}
+
+	s := &snapshot{candidates: []candidate{{labels: map[string]string{LabelHealthCheckPath: "/healthz"}}}}
+	if !hasHealthChecks(s) {
+		t.Fatal("hasHealthChecks() = false, want true")
+	}
+	i.startHealthChecks()
+	if i.stopHealth == nil {
+		t.Error("startHealthChecks didn't start the health checks")
+	}
+}
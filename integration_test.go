@@ -0,0 +1,223 @@
+//go:build integration
+
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// The integration tests run the discovery loop against the docker daemon of
+// DOCKER_HOST, and are skipped when it is unreachable:
+//
+//	go test -tags integration -run Integration ./...
+//
+// CADDY_E2E_IMAGE is the image of the test containers, busybox by default,
+// which must serve http with `httpd`. CADDY_E2E_RESTART_CMD is the shell
+// command restarting the daemon, e.g. `sudo systemctl restart docker`, the
+// daemon restart test is skipped without it.
+
+const integrationTimeout = 30 * time.Second
+
+// integration holds a docker client and a provisioned module discovering
+// the containers of the test only.
+type integration struct {
+	t     *testing.T
+	cli   *client.Client
+	u     *Upstreams
+	image string
+	run   string
+}
+
+func newIntegration(t *testing.T) *integration {
+	t.Helper()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		t.Skipf("docker client unavailable: %v", err)
+	}
+	pingCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cli.Ping(pingCtx); err != nil {
+		cli.Close()
+		t.Skipf("docker daemon unavailable: %v", err)
+	}
+
+	image := os.Getenv("CADDY_E2E_IMAGE")
+	if image == "" {
+		image = "busybox:latest"
+	}
+	pullCtx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	reader, err := cli.ImagePull(pullCtx, image, types.ImagePullOptions{})
+	if err != nil {
+		t.Fatalf("unable to pull %s: %v", image, err)
+	}
+	_, _ = io.Copy(io.Discard, reader)
+	reader.Close()
+
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	ctx, cancelCtx := caddy.NewContext(caddy.Context{Context: context.Background()})
+	u := &Upstreams{
+		Instance:    "integration-" + run,
+		FilterLabel: []string{"com.caddyserver.test.run=" + run},
+		Debounce:    caddy.Duration(100 * time.Millisecond),
+	}
+	if err := u.Provision(ctx); err != nil {
+		cancelCtx()
+		t.Fatalf("unable to provision: %v", err)
+	}
+
+	i := &integration{t: t, cli: cli, u: u, image: image, run: run}
+	t.Cleanup(func() {
+		cancelCtx()
+		cli.Close()
+	})
+	return i
+}
+
+// startContainer runs a labeled container serving http on port 8080, which
+// is removed when the test ends.
+func (i *integration) startContainer(restart string) string {
+	i.t.Helper()
+	ctx := context.Background()
+
+	created, err := i.cli.ContainerCreate(ctx, &container.Config{
+		Image: i.image,
+		Cmd:   []string{"httpd", "-f", "-p", "8080"},
+		Labels: map[string]string{
+			LabelEnable:                    "true",
+			LabelUpstreamPort:              "8080",
+			LabelMatchHost:                 "integration.example.com",
+			"com.caddyserver.test.run":     i.run,
+			"com.caddyserver.test.harness": "caddy-docker-upstreams",
+		},
+	}, &container.HostConfig{RestartPolicy: container.RestartPolicy{Name: restart}}, nil, nil, "")
+	if err != nil {
+		i.t.Fatalf("unable to create container: %v", err)
+	}
+	i.t.Cleanup(func() {
+		_ = i.cli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+	})
+
+	if err := i.cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		i.t.Fatalf("unable to start container: %v", err)
+	}
+	return created.ID
+}
+
+// hasCandidate reports whether the container is a candidate of the module.
+func (i *integration) hasCandidate(id string) bool {
+	for _, c := range i.u.instance.loadSnapshot().candidates {
+		if c.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// waitCandidate waits until the container is a candidate, or isn't anymore.
+func (i *integration) waitCandidate(id string, present bool) {
+	i.t.Helper()
+
+	deadline := time.Now().Add(integrationTimeout)
+	for time.Now().Before(deadline) {
+		if i.hasCandidate(id) == present {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	i.t.Fatalf("container %.12s candidate = %v after %v, want %v", id, !present, integrationTimeout, present)
+}
+
+func TestIntegrationStartStop(t *testing.T) {
+	i := newIntegration(t)
+
+	id := i.startContainer("no")
+	i.waitCandidate(id, true)
+
+	timeout := 1
+	if err := i.cli.ContainerStop(context.Background(), id, container.StopOptions{Timeout: &timeout}); err != nil {
+		t.Fatalf("unable to stop container: %v", err)
+	}
+	i.waitCandidate(id, false)
+
+	if err := i.cli.ContainerStart(context.Background(), id, types.ContainerStartOptions{}); err != nil {
+		t.Fatalf("unable to start container again: %v", err)
+	}
+	i.waitCandidate(id, true)
+}
+
+func TestIntegrationRemove(t *testing.T) {
+	i := newIntegration(t)
+
+	id := i.startContainer("no")
+	i.waitCandidate(id, true)
+
+	if err := i.cli.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true}); err != nil {
+		t.Fatalf("unable to remove container: %v", err)
+	}
+	i.waitCandidate(id, false)
+}
+
+func TestIntegrationPause(t *testing.T) {
+	i := newIntegration(t)
+
+	id := i.startContainer("no")
+	i.waitCandidate(id, true)
+
+	if err := i.cli.ContainerPause(context.Background(), id); err != nil {
+		t.Fatalf("unable to pause container: %v", err)
+	}
+	i.waitCandidate(id, false)
+
+	if err := i.cli.ContainerUnpause(context.Background(), id); err != nil {
+		t.Fatalf("unable to unpause container: %v", err)
+	}
+	i.waitCandidate(id, true)
+}
+
+func TestIntegrationDaemonRestart(t *testing.T) {
+	restart := os.Getenv("CADDY_E2E_RESTART_CMD")
+	if restart == "" {
+		t.Skip("CADDY_E2E_RESTART_CMD is not set")
+	}
+	i := newIntegration(t)
+
+	id := i.startContainer("always")
+	i.waitCandidate(id, true)
+
+	restarted := time.Now()
+	out, err := exec.Command("sh", "-c", restart).CombinedOutput()
+	if err != nil {
+		t.Fatalf("unable to restart the daemon: %v: %s", err, out)
+	}
+
+	// The container is restarted by its restart policy, and listed again
+	// once the event stream reconnects.
+	deadline := time.Now().Add(integrationTimeout)
+	for !i.u.instance.loadSnapshot().refreshed.After(restarted) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no refresh after the daemon restart within %v", integrationTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	i.waitCandidate(id, true)
+
+	timeout := 1
+	if err := i.cli.ContainerStop(context.Background(), id, container.StopOptions{Timeout: &timeout}); err != nil {
+		t.Fatalf("unable to stop container: %v", err)
+	}
+	i.waitCandidate(id, false)
+}
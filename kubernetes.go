@@ -0,0 +1,418 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Kubernetes{})
+}
+
+// Kubernetes discovers upstreams from the annotated services of a Kubernetes
+// cluster, with the kubernetes provider. It takes the options of the docker
+// module, except provider and the docker modes.
+//
+//	dynamic kubernetes {
+//		host     <address>
+//		tls_ca   <path|pem>
+//		tls_cert <path|pem>
+//		tls_key  <path|pem>
+//		...
+//	}
+type Kubernetes struct {
+	Upstreams
+}
+
+func (Kubernetes) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.kubernetes",
+		New: func() caddy.Module { return new(Kubernetes) },
+	}
+}
+
+func (k *Kubernetes) Provision(ctx caddy.Context) error {
+	if k.Provider != "" && k.Provider != ProviderKubernetes || len(k.ProvidersRaw) > 0 {
+		return errors.New("provider is not an option of the kubernetes module")
+	}
+	k.Provider = ProviderKubernetes
+	return k.Upstreams.Provision(ctx)
+}
+
+const (
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeServiceNameLabel  = "kubernetes.io/service-name"
+
+	kubeServicesPath       = "/api/v1/services"
+	kubeEndpointSlicesPath = "/apis/discovery.k8s.io/v1/endpointslices"
+)
+
+// kubeClient is a client of the Kubernetes API server.
+type kubeClient struct {
+	address string
+	// tokenFile is the service account token, read for every request since
+	// it is rotated.
+	tokenFile string
+	http      *http.Client
+}
+
+// newKubeClient creates a Kubernetes client. Inside a pod it defaults to the
+// API server of the cluster with the service account of the pod.
+func newKubeClient(config Endpoint) (*kubeClient, error) {
+	address := config.Host
+	if address == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("no kubernetes host, and not running in a cluster")
+		}
+		address = "https://" + net.JoinHostPort(host, port)
+	}
+
+	tokenFile := kubeServiceAccountDir + "/token"
+	if !fileExists(tokenFile) {
+		tokenFile = ""
+	}
+
+	if ca := kubeServiceAccountDir + "/ca.crt"; config.TLSCA == "" && config.CertPath == "" && fileExists(ca) {
+		config.TLSCA = ca
+	}
+
+	// The certificate of the API server is always verified.
+	config.TLSVerify = true
+	tlsConfig, err := clientTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create tls config: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &kubeClient{
+		address:   strings.TrimSuffix(address, "/"),
+		tokenFile: tokenFile,
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// do sends a GET request of the API path, the caller closes the body.
+func (k *kubeClient) do(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.address+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// get decodes the response of the API path into v.
+func (k *kubeClient) get(ctx context.Context, path string, v any) error {
+	resp, err := k.do(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("unable to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// ping checks the API server answers.
+func (k *kubeClient) ping(ctx context.Context) error {
+	var version struct{ GitVersion string }
+	return k.get(ctx, "/version", &version)
+}
+
+type kubeMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	UID         string            `json:"uid"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type kubeService struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubeEndpointSlice struct {
+	Metadata    kubeMeta `json:"metadata"`
+	AddressType string   `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		TargetRef *struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name     string `json:"name"`
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+	} `json:"ports"`
+}
+
+// kubeProvider provides the ready endpoints of the enabled services of a
+// Kubernetes cluster, configured by the annotations of the services.
+type kubeProvider struct {
+	client    *kubeClient
+	logger    *zap.Logger
+	ipVersion string
+	// enabled reports whether the annotations of a service enable it, the
+	// others are not listed.
+	enabled func(name string, annotations map[string]string) bool
+}
+
+func newKubeProvider(u *Upstreams, config Endpoint) (Provider, string, error) {
+	client, err := newKubeClient(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	enabled := func(name string, annotations map[string]string) bool {
+		labels := u.readLabels(annotations, zap.String("service", name))
+		return labels[LabelEnable] == "true" && hasLabels(labels, u.FilterLabel)
+	}
+	return &kubeProvider{client: client, logger: u.logger, ipVersion: u.IPVersion, enabled: enabled}, client.address, nil
+}
+
+// List returns the ready endpoints of the enabled services, the endpoints of
+// a service share its annotations.
+func (p *kubeProvider) List(ctx context.Context) ([]Target, error) {
+	var services struct{ Items []kubeService }
+	err := p.client.get(ctx, kubeServicesPath, &services)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the list of services: %w", err)
+	}
+
+	var slices struct{ Items []kubeEndpointSlice }
+	err = p.client.get(ctx, kubeEndpointSlicesPath, &slices)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the list of endpoint slices: %w", err)
+	}
+
+	slicesByService := make(map[string][]kubeEndpointSlice, len(services.Items))
+	for _, slice := range slices.Items {
+		key := slice.Metadata.Namespace + "/" + slice.Metadata.Labels[kubeServiceNameLabel]
+		slicesByService[key] = append(slicesByService[key], slice)
+	}
+
+	var targets []Target
+	for _, service := range services.Items {
+		key := service.Metadata.Namespace + "/" + service.Metadata.Name
+		if !p.enabled(key, service.Metadata.Annotations) {
+			continue
+		}
+
+		for _, slice := range kubeSlices(p.ipVersion, slicesByService[key]) {
+			ports := kubePorts(service, slice)
+			for _, endpoint := range slice.Endpoints {
+				// A nil ready condition is an unknown state, which is
+				// interpreted as ready.
+				if ready := endpoint.Conditions.Ready; ready != nil && !*ready || len(endpoint.Addresses) == 0 {
+					continue
+				}
+
+				target := Target{
+					ID:           endpoint.Addresses[0],
+					Name:         endpoint.Addresses[0],
+					Address:      endpoint.Addresses[0],
+					Labels:       service.Metadata.Annotations,
+					Kind:         "service",
+					Object:       key,
+					Placeholders: kubePlaceholders(service),
+					Ports:        ports,
+				}
+				if ref := endpoint.TargetRef; ref != nil {
+					target.ID, target.Name = ref.UID, ref.Name
+				}
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// kubeSlices returns the ip endpoint slices of a service of the ip version,
+// the slices of the other version of a dual-stack service are dropped unless
+// they are the only ones.
+func kubeSlices(ipVersion string, slices []kubeEndpointSlice) []kubeEndpointSlice {
+	byType := make(map[string][]kubeEndpointSlice, 2)
+	for _, slice := range slices {
+		byType[slice.AddressType] = append(byType[slice.AddressType], slice)
+	}
+
+	ipv4, ipv6 := byType["IPv4"], byType["IPv6"]
+	switch ipVersion {
+	case IPVersionIPv4Only:
+		return ipv4
+	case IPVersionIPv6Only:
+		return ipv6
+	case IPVersionPreferIPv6:
+		if len(ipv6) > 0 {
+			return ipv6
+		}
+		return ipv4
+	default:
+		if len(ipv4) > 0 {
+			return ipv4
+		}
+		return ipv6
+	}
+}
+
+// kubePorts returns the tcp ports of the endpoint slice by name, and by the
+// number of the service port of the same name. The ports without name are
+// named by their number.
+func kubePorts(service kubeService, slice kubeEndpointSlice) map[string]int {
+	ports := make(map[string]int, len(slice.Ports))
+	for _, port := range slice.Ports {
+		if port.Protocol != "" && port.Protocol != "TCP" {
+			continue
+		}
+		name := port.Name
+		if name == "" {
+			name = strconv.Itoa(port.Port)
+		}
+		ports[name] = port.Port
+	}
+	for _, port := range service.Spec.Ports {
+		if target, ok := ports[port.Name]; ok && port.Name != "" {
+			ports[strconv.Itoa(port.Port)] = target
+		}
+	}
+	return ports
+}
+
+// kubePlaceholders returns the placeholders of the service annotations.
+func kubePlaceholders(service kubeService) map[string]string {
+	return map[string]string{
+		"service.name":      service.Metadata.Name,
+		"service.namespace": service.Metadata.Namespace,
+		"service.id":        service.Metadata.UID,
+		"service.id.short":  shortID(service.Metadata.UID),
+	}
+}
+
+// Watch notifies the changes of the services and the endpoint slices of the
+// cluster. A watch starts with the current objects, so the changes missed
+// while reconnecting are notified too.
+func (p *kubeProvider) Watch(ctx context.Context, notify func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	for _, path := range []string{kubeServicesPath, kubeEndpointSlicesPath} {
+		go func(path string) { errs <- p.watchPath(ctx, path, notify) }(path)
+	}
+	return <-errs
+}
+
+// watchPath watches the objects of the API path until an error.
+func (p *kubeProvider) watchPath(ctx context.Context, path string, notify func()) error {
+	for {
+		err := p.client.watch(ctx, path, notify)
+		if err != nil {
+			return fmt.Errorf("unable to watch %s: %w", path, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// The API server ends the watches after a timeout.
+		p.logger.Debug("watch is closed by the api server; will reconnect",
+			zap.String("path", path),
+		)
+	}
+}
+
+// Ping checks the API server answers.
+func (p *kubeProvider) Ping(ctx context.Context) error {
+	return p.client.ping(ctx)
+}
+
+// watch calls notify for every event of the objects of the API path, until
+// the watch ends.
+func (k *kubeClient) watch(ctx context.Context, path string, notify func()) error {
+	resp, err := k.do(ctx, path+"?watch=1")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		err := decoder.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			return fmt.Errorf("watch error: %s", event.Object)
+		}
+		notify()
+	}
+}
+
+// Interface guards
+var (
+	_ Provider = (*kubeProvider)(nil)
+	_ Pinger   = (*kubeProvider)(nil)
+
+	_ caddy.Provisioner           = (*Kubernetes)(nil)
+	_ caddy.CleanerUpper          = (*Kubernetes)(nil)
+	_ caddy.Validator             = (*Kubernetes)(nil)
+	_ reverseproxy.UpstreamSource = (*Kubernetes)(nil)
+	_ caddyfile.Unmarshaler       = (*Kubernetes)(nil)
+)
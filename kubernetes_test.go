@@ -0,0 +1,93 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// kubeAPI serves a service of two endpoints, one of them not ready, and
+// watches which stay open.
+func kubeAPI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("watch") != "" {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/version":
+		_, _ = w.Write([]byte(`{"gitVersion": "v1.27.0"}`))
+	case kubeServicesPath:
+		_, _ = w.Write([]byte(`{"items": [{
+			"metadata": {"name": "web", "namespace": "default", "uid": "1234", "annotations": {
+				"com.caddyserver.http.enable": "true",
+				"com.caddyserver.http.upstream.port": "http"
+			}},
+			"spec": {"ports": [{"name": "http", "port": 80}]}
+		}]}`))
+	case kubeEndpointSlicesPath:
+		_, _ = w.Write([]byte(`{"items": [{
+			"metadata": {"name": "web-abc", "namespace": "default", "labels": {"kubernetes.io/service-name": "web"}},
+			"addressType": "IPv4",
+			"endpoints": [
+				{"addresses": ["10.1.0.1"], "conditions": {"ready": true}, "targetRef": {"name": "web-1", "uid": "5678"}},
+				{"addresses": ["10.1.0.2"], "conditions": {"ready": false}}
+			],
+			"ports": [{"name": "http", "port": 8080, "protocol": "TCP"}]
+		}]}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestKubernetesModule(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(kubeAPI))
+	defer srv.Close()
+
+	d := caddyfile.NewTestDispenser(`kubernetes {
+		host ` + srv.URL + `
+		instance test-kubernetes-module
+		label_prefix com.caddyserver.http
+	}`)
+	var k Kubernetes
+	if err := k.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unable to unmarshal: %v", err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := k.Provision(ctx); err != nil {
+		t.Fatalf("unable to provision: %v", err)
+	}
+	defer func() {
+		_ = k.Cleanup()
+		instancesMu.Lock()
+		delete(instances, k.instance.name)
+		instancesMu.Unlock()
+	}()
+
+	upstreams, err := k.GetUpstreams(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if err != nil {
+		t.Fatalf("unable to get upstreams: %v", err)
+	}
+	if len(upstreams) != 1 || upstreams[0].Dial != "10.1.0.1:8080" {
+		t.Fatalf("upstreams = %v, want the ready endpoint on the target port", upstreams)
+	}
+}
+
+func TestKubernetesModuleProvider(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	k := Kubernetes{Upstreams{Provider: ProviderNomad}}
+	if err := k.Provision(ctx); err == nil {
+		t.Fatal("Provision() with another provider succeeded")
+	}
+}
@@ -2,7 +2,10 @@ package caddy_docker_upstreams
 
 import (
 	"net/url"
+	"strconv"
+	"strings"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
@@ -13,20 +16,70 @@ const (
 	LabelMatchPath       = "com.caddyserver.http.matchers.path"
 	LabelMatchQuery      = "com.caddyserver.http.matchers.query"
 	LabelMatchExpression = "com.caddyserver.http.matchers.expression"
+	LabelMatchRemoteIP   = "com.caddyserver.http.matchers.remote_ip"
+	LabelMatchClientIP   = "com.caddyserver.http.matchers.client_ip"
+	// LabelMatchClientIPForwarded matches the first ip of X-Forwarded-For,
+	// which the clients may spoof unless a trusted proxy sets it.
+	LabelMatchClientIPForwarded = "com.caddyserver.http.matchers.client_ip_forwarded"
+
+	// The name of the header follows the prefix, e.g.
+	// com.caddyserver.http.matchers.header.X-Tenant.
+	LabelMatchHeaderPrefix       = "com.caddyserver.http.matchers.header."
+	LabelMatchHeaderRegexpPrefix = "com.caddyserver.http.matchers.header_regexp."
+
+	// The matcher label negated follows the prefix, e.g.
+	// com.caddyserver.http.matchers.not.host.
+	LabelMatchNotPrefix = "com.caddyserver.http.matchers.not."
+
+	labelMatchPrefix = "com.caddyserver.http.matchers."
 )
 
+// matcherGroup returns the index of the matcher group of the label and the
+// label without it, ok is false if the label has no group. The matcher
+// label of a group follows its index, e.g. com.caddyserver.http.matchers.0.host,
+// the matchers of a group are ANDed and the groups are ORed.
+func matcherGroup(key string) (group int, ungrouped string, ok bool) {
+	rest := strings.TrimPrefix(key, labelMatchPrefix)
+	if rest == key {
+		return 0, key, false
+	}
+
+	index, name, found := strings.Cut(rest, ".")
+	if !found || name == "" || !isIndex(index) {
+		return 0, key, false
+	}
+
+	group, err := strconv.Atoi(index)
+	if err != nil {
+		return 0, key, false
+	}
+	return group, labelMatchPrefix + name, true
+}
+
+func isIndex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 var producers = map[string]func(string) (caddyhttp.RequestMatcher, error){
 	LabelMatchProtocol: func(value string) (caddyhttp.RequestMatcher, error) {
 		return caddyhttp.MatchProtocol(value), nil
 	},
 	LabelMatchHost: func(value string) (caddyhttp.RequestMatcher, error) {
-		return caddyhttp.MatchHost{value}, nil
+		return caddyhttp.MatchHost(splitValues(value)), nil
 	},
 	LabelMatchMethod: func(value string) (caddyhttp.RequestMatcher, error) {
-		return caddyhttp.MatchMethod{value}, nil
+		return caddyhttp.MatchMethod(splitValues(strings.ToUpper(value))), nil
 	},
 	LabelMatchPath: func(value string) (caddyhttp.RequestMatcher, error) {
-		return caddyhttp.MatchPath{value}, nil
+		return caddyhttp.MatchPath(splitValues(value)), nil
 	},
 	LabelMatchQuery: func(value string) (caddyhttp.RequestMatcher, error) {
 		query, err := url.ParseQuery(value)
@@ -35,7 +88,119 @@ var producers = map[string]func(string) (caddyhttp.RequestMatcher, error){
 		}
 		return caddyhttp.MatchQuery(query), nil
 	},
+	LabelMatchRemoteIP: func(value string) (caddyhttp.RequestMatcher, error) {
+		return &caddyhttp.MatchRemoteIP{Ranges: splitValues(value)}, nil
+	},
+	// The client ip is the remote address of the connection, which the
+	// clients can't spoof unlike the headers.
+	LabelMatchClientIP: func(value string) (caddyhttp.RequestMatcher, error) {
+		return &caddyhttp.MatchRemoteIP{Ranges: splitValues(value)}, nil
+	},
+	LabelMatchClientIPForwarded: func(value string) (caddyhttp.RequestMatcher, error) {
+		return &caddyhttp.MatchRemoteIP{Ranges: splitValues(value), Forwarded: true}, nil
+	},
+	// The expression is compiled when the matcher is provisioned.
 	LabelMatchExpression: func(value string) (caddyhttp.RequestMatcher, error) {
-		return caddyhttp.MatchExpression{Expr: value}, nil
+		return &caddyhttp.MatchExpression{Expr: value}, nil
+	},
+}
+
+// prefixedProducers produce the matchers of the labels starting with a
+// prefix, the rest of the label is passed as name.
+var prefixedProducers = map[string]func(name, value string) (caddyhttp.RequestMatcher, error){
+	LabelMatchHeaderPrefix: func(name, value string) (caddyhttp.RequestMatcher, error) {
+		return caddyhttp.MatchHeader{name: []string{value}}, nil
 	},
+	LabelMatchHeaderRegexpPrefix: func(name, value string) (caddyhttp.RequestMatcher, error) {
+		return caddyhttp.MatchHeaderRE{name: &caddyhttp.MatchRegexp{Pattern: value}}, nil
+	},
+}
+
+// produceMatcher returns the matcher of the label, ok is false if the label
+// is not a matcher label.
+func produceMatcher(key, value string) (matcher caddyhttp.RequestMatcher, ok bool, err error) {
+	if _, ungrouped, grouped := matcherGroup(key); grouped {
+		return produceMatcher(ungrouped, value)
+	}
+
+	if name := strings.TrimPrefix(key, LabelMatchNotPrefix); name != key {
+		matcher, ok, err = produceMatcher(labelMatchPrefix+name, value)
+		if !ok || err != nil {
+			return nil, ok, err
+		}
+		return &notMatcher{caddyhttp.MatchNot{MatcherSets: []caddyhttp.MatcherSet{{matcher}}}}, true, nil
+	}
+
+	if producer, ok := producers[key]; ok {
+		matcher, err = producer(value)
+		return matcher, true, err
+	}
+
+	for prefix, producer := range prefixedProducers {
+		if name := strings.TrimPrefix(key, prefix); name != key && name != "" {
+			matcher, err = producer(name, value)
+			return matcher, true, err
+		}
+	}
+
+	return nil, false, nil
+}
+
+func isMatcherLabel(key string) bool {
+	if _, ungrouped, grouped := matcherGroup(key); grouped {
+		return isMatcherLabel(ungrouped)
+	}
+
+	if name := strings.TrimPrefix(key, LabelMatchNotPrefix); name != key {
+		return isMatcherLabel(labelMatchPrefix + name)
+	}
+
+	if _, ok := producers[key]; ok {
+		return true
+	}
+
+	for prefix := range prefixedProducers {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return true
+		}
+	}
+
+	return false
 }
+
+// notMatcher negates the matcher of a label, unlike MatchNot it provisions
+// the matcher itself instead of loading it from the raw config.
+type notMatcher struct {
+	caddyhttp.MatchNot
+}
+
+func (m *notMatcher) Provision(ctx caddy.Context) error {
+	for _, set := range m.MatcherSets {
+		for _, matcher := range set {
+			if prov, ok := matcher.(caddy.Provisioner); ok {
+				err := prov.Provision(ctx)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// splitValues splits the comma-separated values of a label.
+func splitValues(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner        = (*notMatcher)(nil)
+	_ caddyhttp.RequestMatcher = (*notMatcher)(nil)
+)
@@ -0,0 +1,135 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// matchLabel produces and provisions the matcher of the label, and matches
+// req against it.
+func matchLabel(t *testing.T, key, value string, req *http.Request) bool {
+	t.Helper()
+
+	matcher, ok, err := produceMatcher(key, value)
+	if !ok || err != nil {
+		t.Fatalf("produceMatcher(%q, %q) = %v, %v", key, value, ok, err)
+	}
+	if prov, ok := matcher.(caddy.Provisioner); ok {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		if err := prov.Provision(ctx); err != nil {
+			t.Fatalf("provision %q: %v", key, err)
+		}
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	return matcher.Match(req)
+}
+
+func TestQueryMatcher(t *testing.T) {
+	tests := []struct {
+		value   string
+		query   string
+		matches bool
+	}{
+		{value: "version=beta", query: "version=beta", matches: true},
+		{value: "version=beta", query: "version=stable", matches: false},
+		{value: "version=beta", query: "", matches: false},
+		{value: "version=beta", query: "page=2&version=beta", matches: true},
+		{value: "version=beta&version=rc", query: "version=rc", matches: true},
+		{value: "version=*", query: "version=stable", matches: true},
+		{value: "version=*", query: "page=2", matches: false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/?"+tt.query, nil)
+		if got := matchLabel(t, LabelMatchQuery, tt.value, req); got != tt.matches {
+			t.Errorf("query %q on %q: match = %v, want %v", tt.value, tt.query, got, tt.matches)
+		}
+	}
+
+	if _, _, err := produceMatcher(LabelMatchQuery, "version=%zz"); err == nil {
+		t.Error("produceMatcher() with an invalid query, want an error")
+	}
+}
+
+func TestClientIPMatchers(t *testing.T) {
+	tests := []struct {
+		key          string
+		remoteAddr   string
+		forwardedFor string
+		matches      bool
+	}{
+		{key: LabelMatchClientIP, remoteAddr: "10.0.0.5:1234", matches: true},
+		{key: LabelMatchClientIP, remoteAddr: "203.0.113.7:1234", matches: false},
+		// A client may not spoof its way into the allow-list.
+		{key: LabelMatchClientIP, remoteAddr: "203.0.113.7:1234", forwardedFor: "10.0.0.5", matches: false},
+		{key: LabelMatchClientIPForwarded, remoteAddr: "192.0.2.1:1234", forwardedFor: "10.0.0.5", matches: true},
+		{key: LabelMatchClientIPForwarded, remoteAddr: "10.0.0.5:1234", forwardedFor: "203.0.113.7", matches: false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := matchLabel(t, tt.key, "10.0.0.0/8", req); got != tt.matches {
+			t.Errorf("%s from %s, X-Forwarded-For %q: match = %v, want %v", tt.key, tt.remoteAddr, tt.forwardedFor, got, tt.matches)
+		}
+	}
+}
+
+func TestHostMatcher(t *testing.T) {
+	tests := []struct {
+		value   string
+		host    string
+		matches bool
+	}{
+		{value: "a.example.com", host: "a.example.com", matches: true},
+		{value: "a.example.com", host: "b.example.com", matches: false},
+		{value: "a.example.com,b.example.com", host: "b.example.com", matches: true},
+		{value: "a.example.com, b.example.com", host: "b.example.com", matches: true},
+		{value: "a.example.com, b.example.com", host: "c.example.com", matches: false},
+		{value: "*.example.com", host: "a.example.com", matches: true},
+		{value: "*.example.com", host: "example.com", matches: false},
+		{value: "*.example.com", host: "a.b.example.com", matches: false},
+		{value: "A.Example.com", host: "a.example.COM", matches: true},
+		{value: "a.example.com", host: "a.example.com:8443", matches: true},
+		{value: "*.example.com", host: "a.example.com:8443", matches: true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+		if got := matchLabel(t, LabelMatchHost, tt.value, req); got != tt.matches {
+			t.Errorf("host %q on %q: match = %v, want %v", tt.value, tt.host, got, tt.matches)
+		}
+	}
+}
+
+func TestMatcherGroup(t *testing.T) {
+	tests := []struct {
+		key       string
+		group     int
+		ungrouped string
+		ok        bool
+	}{
+		{key: labelMatchPrefix + "0.host", group: 0, ungrouped: LabelMatchHost, ok: true},
+		{key: labelMatchPrefix + "12.path", group: 12, ungrouped: LabelMatchPath, ok: true},
+		{key: LabelMatchHost, ungrouped: LabelMatchHost},
+		{key: labelMatchPrefix + "x.host", ungrouped: labelMatchPrefix + "x.host"},
+		{key: labelMatchPrefix + "0.", ungrouped: labelMatchPrefix + "0."},
+		{key: LabelEnable, ungrouped: LabelEnable},
+	}
+
+	for _, tt := range tests {
+		group, ungrouped, ok := matcherGroup(tt.key)
+		if group != tt.group || ungrouped != tt.ungrouped || ok != tt.ok {
+			t.Errorf("matcherGroup(%q) = %d, %q, %v, want %d, %q, %v", tt.key, group, ungrouped, ok, tt.group, tt.ungrouped, tt.ok)
+		}
+	}
+}
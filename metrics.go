@@ -0,0 +1,75 @@
+package caddy_docker_upstreams
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics are registered to the default registry, which Caddy serves on
+// the /metrics admin endpoint.
+var metrics = struct {
+	containers     *prometheus.GaugeVec
+	candidates     *prometheus.GaugeVec
+	lastRefresh    prometheus.Gauge
+	reconnects     *prometheus.CounterVec
+	streamUp       *prometheus.GaugeVec
+	apiErrors      *prometheus.CounterVec
+	upstreamsCount *prometheus.CounterVec
+	quarantined    *prometheus.GaugeVec
+	stale          *prometheus.GaugeVec
+}{
+	containers: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "containers",
+		Help:      "Number of containers, or tasks in swarm mode, last listed from the endpoint.",
+	}, []string{"endpoint"}),
+	candidates: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "candidates",
+		Help:      "Number of upstreams of the instance which requests may be matched to.",
+	}, []string{"instance"}),
+	lastRefresh: promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "last_refresh_timestamp_seconds",
+		Help:      "Time the upstreams were last rebuilt.",
+	}),
+	reconnects: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "event_stream_reconnects_total",
+		Help:      "Number of times the event stream of the endpoint was reconnected.",
+	}, []string{"endpoint"}),
+	streamUp: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "event_stream_up",
+		Help:      "Whether the event stream of the endpoint is connected.",
+	}, []string{"endpoint"}),
+	apiErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "api_errors_total",
+		Help:      "Number of failed docker API requests of the endpoint.",
+	}, []string{"endpoint"}),
+	upstreamsCount: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "get_upstreams_total",
+		Help:      "Number of requests looking up upstreams, by whether any upstream matched or the fallback is used.",
+	}, []string{"result"}),
+	quarantined: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "quarantined",
+		Help:      "Number of upstreams of the instance quarantined for failing the probes.",
+	}, []string{"instance"}),
+	stale: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "docker_upstreams",
+		Name:      "stale",
+		Help:      "Whether the upstreams of the endpoint are older than max_staleness while its event stream is down.",
+	}, []string{"endpoint"}),
+}
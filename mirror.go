@@ -0,0 +1,20 @@
+package caddy_docker_upstreams
+
+import "net/http"
+
+// LabelMirror marks the container as a mirror, which never serves the
+// requests but is looked up by LookupMirrors.
+const LabelMirror = "com.caddyserver.http.mirror"
+
+// LookupMirrors returns the mirror upstreams of every instance whose
+// matchers match r, for a handler to send a copy of the request to. r must be
+// a request served by Caddy, whose context holds the replacer.
+func LookupMirrors(r *http.Request) []UpstreamInfo {
+	var infos []UpstreamInfo
+	for _, info := range LookupRequest(r) {
+		if info.Mirror {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
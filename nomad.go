@@ -0,0 +1,269 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultNomadAddress = "http://127.0.0.1:4646"
+
+// nomadWait is the longest time a blocking query of the service list waits
+// for a change.
+const nomadWait = 5 * time.Minute
+
+// nomadClient is a client of the Nomad HTTP API.
+type nomadClient struct {
+	address string
+	token   string
+	http    *http.Client
+}
+
+// newNomadClient creates a Nomad client, the configured options take
+// precedence over the NOMAD_ADDR and NOMAD_TOKEN environment variables.
+func newNomadClient(config Endpoint) (*nomadClient, error) {
+	address := config.Host
+	if address == "" {
+		address = os.Getenv("NOMAD_ADDR")
+	}
+	if address == "" {
+		address = defaultNomadAddress
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CertPath != "" || config.TLSCA != "" || config.TLSCert != "" || config.TLSKey != "" {
+		tlsConfig, err := clientTLSConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create tls config: %w", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &nomadClient{
+		address: strings.TrimSuffix(address, "/"),
+		token:   os.Getenv("NOMAD_TOKEN"),
+		http:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// get decodes the response of the API path into v, and returns the index of
+// the response used by blocking queries.
+func (n *nomadClient) get(ctx context.Context, path string, query url.Values, v any) (uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.address+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if n.token != "" {
+		req.Header.Set("X-Nomad-Token", n.token)
+	}
+
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decode %s: %w", path, err)
+	}
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+	return index, nil
+}
+
+// ping checks the agent answers.
+func (n *nomadClient) ping(ctx context.Context) error {
+	var leader string
+	_, err := n.get(ctx, "/v1/status/leader", nil, &leader)
+	return err
+}
+
+type nomadServiceList struct {
+	Namespace string
+	Services  []struct {
+		ServiceName string
+		Tags        []string
+	}
+}
+
+// nomadRegistration is an instance of a Nomad service, registered by an
+// allocation.
+type nomadRegistration struct {
+	ID          string
+	ServiceName string
+	Namespace   string
+	JobID       string
+	AllocID     string
+	Tags        []string
+	Address     string
+	Port        int
+}
+
+// nomadLabels returns the tags as labels, a tag `<key>=<value>` is the label
+// key with the value, and a tag without value is set to true.
+func nomadLabels(tags []string) map[string]string {
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			value = "true"
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels
+}
+
+// hasLabels reports whether labels have all the filters, either `<key>` or
+// `<key>=<value>`.
+func hasLabels(labels map[string]string, filters []string) bool {
+	for _, filter := range filters {
+		key, value, hasValue := strings.Cut(filter, "=")
+		actual, ok := labels[key]
+		if !ok || hasValue && actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// nomadProvider provides the instances of the enabled services of a Nomad
+// cluster, watched with blocking queries.
+type nomadProvider struct {
+	client *nomadClient
+	logger *zap.Logger
+	// enabled reports whether the tags of a service enable it, the others
+	// are not listed.
+	enabled func(name string, tags []string) bool
+}
+
+func newNomadProvider(u *Upstreams, config Endpoint) (Provider, string, error) {
+	client, err := newNomadClient(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	enabled := func(name string, tags []string) bool {
+		labels := u.readLabels(nomadLabels(tags), zap.String("service", name))
+		return labels[LabelEnable] == "true" && hasLabels(labels, u.FilterLabel)
+	}
+	return &nomadProvider{client: client, logger: u.logger, enabled: enabled}, client.address, nil
+}
+
+// services lists the services of all namespaces, and returns the index of
+// the list. A non-zero index blocks until the list changes past it.
+func (p *nomadProvider) services(ctx context.Context, index uint64) ([]nomadServiceList, uint64, error) {
+	query := url.Values{"namespace": {"*"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", nomadWait.String())
+	}
+
+	var lists []nomadServiceList
+	index, err := p.client.get(ctx, "/v1/services", query, &lists)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to get the list of services: %w", err)
+	}
+	return lists, index, nil
+}
+
+// List returns the registrations of the enabled services.
+func (p *nomadProvider) List(ctx context.Context) ([]Target, error) {
+	lists, _, err := p.services(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	for _, list := range lists {
+		for _, service := range list.Services {
+			if !p.enabled(service.ServiceName, service.Tags) {
+				continue
+			}
+
+			var registrations []nomadRegistration
+			_, err := p.client.get(ctx, "/v1/service/"+url.PathEscape(service.ServiceName), url.Values{"namespace": {list.Namespace}}, &registrations)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get the registrations of service '%s': %w", service.ServiceName, err)
+			}
+
+			for _, r := range registrations {
+				if r.Address == "" || r.Port == 0 {
+					p.logger.Error("unable to get address from service registration",
+						zap.String("service_id", r.ID),
+					)
+					continue
+				}
+				targets = append(targets, Target{
+					ID:      r.ID,
+					Name:    r.ServiceName + "." + shortID(r.AllocID),
+					Address: net.JoinHostPort(r.Address, strconv.Itoa(r.Port)),
+					// The tags may differ between the instances.
+					Labels:       nomadLabels(r.Tags),
+					Kind:         "service",
+					Object:       r.ServiceName,
+					Placeholders: nomadPlaceholders(r),
+				})
+			}
+		}
+	}
+	return targets, nil
+}
+
+// Watch notifies the changes of the service list with blocking queries.
+func (p *nomadProvider) Watch(ctx context.Context, notify func()) error {
+	var index uint64
+	for {
+		_, next, err := p.services(ctx, index)
+		if err != nil {
+			return err
+		}
+		if index > 0 && next != index {
+			notify()
+		}
+
+		// The index may go backwards after a restore of the servers.
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// Ping checks the agent answers.
+func (p *nomadProvider) Ping(ctx context.Context) error {
+	return p.client.ping(ctx)
+}
+
+// nomadPlaceholders returns the placeholders of the service tags.
+func nomadPlaceholders(r nomadRegistration) map[string]string {
+	return map[string]string{
+		"service.name":   r.ServiceName,
+		"service.id":     r.ID,
+		"job.id":         r.JobID,
+		"alloc.id":       r.AllocID,
+		"alloc.id.short": shortID(r.AllocID),
+		"namespace":      r.Namespace,
+	}
+}
+
+// Interface guards
+var (
+	_ Provider = (*nomadProvider)(nil)
+	_ Pinger   = (*nomadProvider)(nil)
+)
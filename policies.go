@@ -0,0 +1,230 @@
+package caddy_docker_upstreams
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const LabelLBPolicy = "com.caddyserver.http.reverse_proxy.lb_policy"
+
+// Policies of the lb_policy label.
+const (
+	PolicyFirst        = "first"
+	PolicyRandom       = "random"
+	PolicyRandomChoose = "random_choose"
+	PolicyLeastConn    = "least_conn"
+	PolicyRoundRobin   = "round_robin"
+	PolicyIPHash       = "ip_hash"
+	PolicyURIHash      = "uri_hash"
+	PolicyHeader       = "header"
+)
+
+// lbPolicy orders the upstreams of a candidate group for the lb_policy label.
+// The upstreams are not provisioned by reverse_proxy when getting them, so the
+// policy never reads their hosts and the selection itself is left to the
+// selection_policy of reverse_proxy, e.g. `first` to follow the order.
+type lbPolicy struct {
+	name string
+	// field is the header field of the header policy.
+	field string
+	// next is the rotation of the round_robin policy.
+	next atomic.Uint32
+}
+
+// groupKey identifies the candidates sharing the same selection policy and
+// matchers.
+func groupKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		if key == LabelLBPolicy || isMatcherLabel(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", key, labels[key])
+	}
+	return b.String()
+}
+
+// parsePolicy parses the lb_policy label, which uses the Caddyfile syntax of
+// lb_policy, e.g. `header X-Tenant`.
+func parsePolicy(value string) (*lbPolicy, error) {
+	args := strings.Fields(value)
+	if len(args) == 0 {
+		return nil, errors.New("missing selection policy name")
+	}
+
+	p := &lbPolicy{name: args[0]}
+	switch p.name {
+	case PolicyFirst, PolicyRandom, PolicyLeastConn, PolicyRoundRobin, PolicyIPHash, PolicyURIHash:
+		if len(args) > 1 {
+			return nil, fmt.Errorf("selection policy %s takes no argument", p.name)
+		}
+	case PolicyRandomChoose:
+		if len(args) > 2 {
+			return nil, fmt.Errorf("selection policy %s takes at most one argument", p.name)
+		}
+		if len(args) == 2 {
+			if n, err := strconv.Atoi(args[1]); err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid choices '%s'", args[1])
+			}
+		}
+	case PolicyHeader:
+		if len(args) != 2 {
+			return nil, fmt.Errorf("selection policy %s takes the header field", p.name)
+		}
+		p.field = args[1]
+	case "cookie":
+		// The cookie policy needs the response writer which is not
+		// available when getting upstreams.
+		return nil, errors.New("cookie selection policy is not supported")
+	default:
+		return nil, fmt.Errorf("unrecognized selection policy '%s'", p.name)
+	}
+	return p, nil
+}
+
+// provisionPolicy returns the selection policy of the candidate group, or nil
+// if the lb_policy label is absent. The policies of the previous refresh are
+// reused so round_robin carries on.
+func provisionPolicy(labels map[string]string, previous, used map[string]*lbPolicy) (string, *lbPolicy, error) {
+	value, ok := labels[LabelLBPolicy]
+	if !ok {
+		return "", nil, nil
+	}
+
+	key := groupKey(labels)
+	if policy, ok := used[key]; ok {
+		return key, policy, nil
+	}
+	if policy, ok := previous[key]; ok {
+		used[key] = policy
+		return key, policy, nil
+	}
+
+	policy, err := parsePolicy(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	used[key] = policy
+	return key, policy, nil
+}
+
+// order returns the candidates of one group in the order of the policy, the
+// candidates are weighted by repeating them, and each is kept once at its
+// first place. first and least_conn keep the order, the latter being left to
+// reverse_proxy which knows the request counts.
+func (p *lbPolicy) order(group []candidate, r *http.Request) []candidate {
+	var slots []int
+	for i, c := range group {
+		for j := 0; j < c.weight; j++ {
+			slots = append(slots, i)
+		}
+	}
+	if len(slots) < 2 {
+		return group
+	}
+
+	switch p.name {
+	case PolicyRandom, PolicyRandomChoose:
+		rand.Shuffle(len(slots), func(i, j int) { slots[i], slots[j] = slots[j], slots[i] })
+	case PolicyRoundRobin:
+		offset := int((p.next.Add(1) - 1) % uint32(len(slots)))
+		slots = append(slots[offset:], slots[:offset]...)
+	case PolicyIPHash:
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		slots = byHash(group, slots, ip)
+	case PolicyURIHash:
+		slots = byHash(group, slots, r.RequestURI)
+	case PolicyHeader:
+		value := r.Header.Get(p.field)
+		if p.field == "Host" && r.Host != "" {
+			value = r.Host
+		}
+		if value == "" {
+			rand.Shuffle(len(slots), func(i, j int) { slots[i], slots[j] = slots[j], slots[i] })
+			break
+		}
+		slots = byHash(group, slots, value)
+	default:
+		return group
+	}
+
+	ordered := make([]candidate, 0, len(group))
+	seen := make([]bool, len(group))
+	for _, i := range slots {
+		if !seen[i] {
+			seen[i] = true
+			ordered = append(ordered, group[i])
+		}
+	}
+	return ordered
+}
+
+// byHash orders the slots by their rendezvous hash with key, highest first
+// like the hash policies of reverse_proxy, so a key keeps its upstream while
+// the others come and go.
+func byHash(group []candidate, slots []int, key string) []int {
+	hashes := make([]uint32, len(slots))
+	repeats := make([]int, len(group))
+	for n, i := range slots {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%s#%d%s", group[i].address, repeats[i], key)
+		hashes[n] = h.Sum32()
+		repeats[i]++
+	}
+
+	order := make([]int, len(slots))
+	for n := range order {
+		order[n] = n
+	}
+	sort.SliceStable(order, func(a, b int) bool { return hashes[order[a]] > hashes[order[b]] })
+
+	sorted := make([]int, len(slots))
+	for n, o := range order {
+		sorted[n] = slots[o]
+	}
+	return sorted
+}
+
+// orderByPolicy orders the matched candidates of every group by the policy of
+// the group. The groups keep their place after the first of their members,
+// and no candidate is dropped, the selection being left to reverse_proxy.
+func orderByPolicy(matched []candidate, r *http.Request) []candidate {
+	var keys []string
+	groups := make(map[string][]candidate)
+	for _, c := range matched {
+		if _, ok := groups[c.group]; !ok {
+			keys = append(keys, c.group)
+		}
+		groups[c.group] = append(groups[c.group], c)
+	}
+	if len(keys) == len(matched) {
+		return matched
+	}
+
+	ordered := make([]candidate, 0, len(matched))
+	for _, key := range keys {
+		group := groups[key]
+		if group[0].policy != nil {
+			group = group[0].policy.order(group, r)
+		}
+		ordered = append(ordered, group...)
+	}
+	return ordered
+}
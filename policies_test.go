@@ -0,0 +1,137 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func TestGetUpstreamsLeastConnMaxRequests(t *testing.T) {
+	labels := map[string]string{
+		LabelLBPolicy:            "least_conn",
+		LabelUpstreamMaxRequests: "2",
+	}
+	d := newFakeDaemon(t,
+		fakeContainer("web-1", "172.17.0.2", labels),
+		fakeContainer("web-2", "172.17.0.3", labels),
+	)
+	u := d.provision(0)
+	waitCandidates(t, u, func(candidates []candidate) bool { return len(candidates) == 2 })
+
+	// The upstreams are not provisioned by reverse_proxy yet, which selects
+	// one of them with its own least_conn and max_requests.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	upstreams, err := u.GetUpstreams(req)
+	if err != nil {
+		t.Fatalf("unable to get upstreams: %v", err)
+	}
+	if len(upstreams) != 2 {
+		t.Fatalf("upstreams = %v, want both containers", upstreams)
+	}
+	for _, upstream := range upstreams {
+		if upstream.MaxRequests != 2 {
+			t.Errorf("upstream %s max requests = %d, want 2", upstream.Dial, upstream.MaxRequests)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{value: "first", valid: true},
+		{value: "round_robin", valid: true},
+		{value: "random_choose 2", valid: true},
+		{value: "header X-Tenant", valid: true},
+		{value: "", valid: false},
+		{value: "header", valid: false},
+		{value: "first 1", valid: false},
+		{value: "random_choose none", valid: false},
+		{value: "cookie lb", valid: false},
+		{value: "unknown", valid: false},
+	}
+
+	for _, tt := range tests {
+		if _, err := parsePolicy(tt.value); (err == nil) != tt.valid {
+			t.Errorf("parsePolicy(%q) error = %v, want valid %v", tt.value, err, tt.valid)
+		}
+	}
+}
+
+func TestOrderByPolicy(t *testing.T) {
+	group := func(policy *lbPolicy, addresses ...string) []candidate {
+		candidates := make([]candidate, 0, len(addresses))
+		for _, address := range addresses {
+			candidates = append(candidates, candidate{
+				address:  address,
+				upstream: &reverseproxy.Upstream{Dial: address},
+				group:    policy.name,
+				policy:   policy,
+				weight:   1,
+			})
+		}
+		return candidates
+	}
+	addresses := func(candidates []candidate) []string {
+		out := make([]string, 0, len(candidates))
+		for _, c := range candidates {
+			out = append(out, c.address)
+		}
+		return out
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	first, _ := parsePolicy("first")
+	matched := group(first, "a", "b", "c")
+	if got := addresses(orderByPolicy(matched, req)); !equalStrings(got, []string{"a", "b", "c"}) {
+		t.Errorf("first = %v", got)
+	}
+
+	// round_robin rotates the group on every request.
+	roundRobin, _ := parsePolicy("round_robin")
+	matched = group(roundRobin, "a", "b", "c")
+	for _, want := range [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}} {
+		if got := addresses(orderByPolicy(matched, req)); !equalStrings(got, want) {
+			t.Errorf("round_robin = %v, want %v", got, want)
+		}
+	}
+
+	// header keeps the first upstream of a value while the others go.
+	header, _ := parsePolicy("header X-Tenant")
+	req.Header.Set("X-Tenant", "acme")
+	ordered := addresses(orderByPolicy(group(header, "a", "b", "c", "d"), req))
+	if len(ordered) != 4 {
+		t.Fatalf("header = %v, want every candidate", ordered)
+	}
+	var others []string
+	for _, address := range ordered[1:] {
+		if address != ordered[len(ordered)-1] {
+			others = append(others, address)
+		}
+	}
+	kept := addresses(orderByPolicy(group(header, append(others, ordered[0])...), req))
+	if kept[0] != ordered[0] {
+		t.Errorf("header = %v after removing %s, want %s first", kept, ordered[len(ordered)-1], ordered[0])
+	}
+
+	// The candidates without the label keep their place next to the groups.
+	matched = append([]candidate{{address: "x", weight: 1}}, group(first, "a", "b")...)
+	if got := addresses(orderByPolicy(matched, req)); !equalStrings(got, []string{"x", "a", "b"}) {
+		t.Errorf("mixed = %v", got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package caddy_docker_upstreams
+
+import (
+	"sort"
+	"strings"
+)
+
+const labelUpstreamPrefix = "com.caddyserver.http.upstream."
+
+// namedUpstream is an upstream of a container declaring several of them.
+type namedUpstream struct {
+	// name is empty for the upstream of the unnamed labels.
+	name   string
+	labels map[string]string
+}
+
+// namedUpstreams splits the labels of a container declaring named upstreams
+// with `upstream.<name>.port` labels, e.g. upstream.metrics.port. Each named
+// upstream has the labels of the container, where its `upstream.<name>.*`
+// labels override the upstream labels and its `matchers.<name>.*` labels
+// replace the matcher labels. The upstream of the unnamed labels is kept if
+// upstream.port or upstream.socket is set. Without named upstreams the
+// labels are returned as is.
+func namedUpstreams(labels map[string]string) []namedUpstream {
+	var names []string
+	for key := range labels {
+		name := strings.TrimPrefix(key, labelUpstreamPrefix)
+		if name == key || !strings.HasSuffix(name, ".port") {
+			continue
+		}
+		name = strings.TrimSuffix(name, ".port")
+		if name != "" && !strings.Contains(name, ".") && !isMatcherName(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return []namedUpstream{{labels: labels}}
+	}
+	sort.Strings(names)
+
+	isNamed := func(key string) bool {
+		for _, name := range names {
+			if strings.HasPrefix(key, labelUpstreamPrefix+name+".") || strings.HasPrefix(key, labelMatchPrefix+name+".") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var upstreams []namedUpstream
+
+	_, hasPort := labels[LabelUpstreamPort]
+	_, hasSocket := labels[LabelUpstreamSocket]
+	if hasPort || hasSocket {
+		unnamed := make(map[string]string, len(labels))
+		for key, value := range labels {
+			if !isNamed(key) {
+				unnamed[key] = value
+			}
+		}
+		upstreams = append(upstreams, namedUpstream{labels: unnamed})
+	}
+
+	for _, name := range names {
+		named := make(map[string]string, len(labels))
+		for key, value := range labels {
+			// The unnamed port and matchers don't apply.
+			if !isNamed(key) && key != LabelUpstreamPort && key != LabelUpstreamSocket && !isMatcherLabel(key) {
+				named[key] = value
+			}
+		}
+		for key, value := range labels {
+			if suffix := strings.TrimPrefix(key, labelUpstreamPrefix+name+"."); suffix != key {
+				named[labelUpstreamPrefix+suffix] = value
+			}
+			if suffix := strings.TrimPrefix(key, labelMatchPrefix+name+"."); suffix != key {
+				named[labelMatchPrefix+suffix] = value
+			}
+		}
+		upstreams = append(upstreams, namedUpstream{name: name, labels: named})
+	}
+
+	return upstreams
+}
+
+// isMatcherName reports whether the upstream name is ambiguous with the
+// matcher labels, e.g. host or header, or with the matcher groups.
+func isMatcherName(name string) bool {
+	return name == "not" || isIndex(name) || isMatcherLabel(labelMatchPrefix+name) || isMatcherLabel(labelMatchPrefix+name+".name")
+}
@@ -0,0 +1,81 @@
+package caddy_docker_upstreams
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNamedUpstreams(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   []namedUpstream
+	}{
+		{
+			name:   "unnamed",
+			labels: map[string]string{LabelEnable: "true", LabelUpstreamPort: "80", LabelMatchHost: "a.example.com"},
+			want: []namedUpstream{
+				{labels: map[string]string{LabelEnable: "true", LabelUpstreamPort: "80", LabelMatchHost: "a.example.com"}},
+			},
+		},
+		{
+			name: "unnamed and named",
+			labels: map[string]string{
+				LabelEnable:                            "true",
+				LabelUpstreamPort:                      "80",
+				LabelUpstreamWeight:                    "2",
+				LabelMatchHost:                         "a.example.com",
+				labelUpstreamPrefix + "metrics.port":   "9100",
+				labelUpstreamPrefix + "metrics.weight": "5",
+				labelMatchPrefix + "metrics.path":      "/metrics",
+			},
+			want: []namedUpstream{
+				{labels: map[string]string{
+					LabelEnable:         "true",
+					LabelUpstreamPort:   "80",
+					LabelUpstreamWeight: "2",
+					LabelMatchHost:      "a.example.com",
+				}},
+				{name: "metrics", labels: map[string]string{
+					LabelEnable:         "true",
+					LabelUpstreamPort:   "9100",
+					LabelUpstreamWeight: "5",
+					LabelMatchPath:      "/metrics",
+				}},
+			},
+		},
+		{
+			name: "named only",
+			labels: map[string]string{
+				LabelEnable:                        "true",
+				labelUpstreamPrefix + "web.port":   "8080",
+				labelUpstreamPrefix + "admin.port": "9000",
+			},
+			want: []namedUpstream{
+				{name: "admin", labels: map[string]string{LabelEnable: "true", LabelUpstreamPort: "9000"}},
+				{name: "web", labels: map[string]string{LabelEnable: "true", LabelUpstreamPort: "8080"}},
+			},
+		},
+		{
+			name: "matcher name",
+			labels: map[string]string{
+				LabelUpstreamPort:                 "80",
+				labelUpstreamPrefix + "host.port": "8080",
+				labelUpstreamPrefix + "0.port":    "8081",
+			},
+			want: []namedUpstream{
+				{labels: map[string]string{
+					LabelUpstreamPort:                 "80",
+					labelUpstreamPrefix + "host.port": "8080",
+					labelUpstreamPrefix + "0.port":    "8081",
+				}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := namedUpstreams(tt.labels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: namedUpstreams() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package caddy_docker_upstreams
+
+import (
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"go.uber.org/zap"
+)
+
+const LabelUpstreamPriority = "com.caddyserver.http.upstream.priority"
+
+// priorityLabel parses the priority label, which defaults to 0.
+func (u *Upstreams) priorityLabel(labels map[string]string, fields ...zap.Field) int {
+	value, ok := labels[LabelUpstreamPriority]
+	if !ok {
+		return 0
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		u.logger.Error("invalid integer label", append(fields,
+			zap.String("key", LabelUpstreamPriority),
+			zap.String("value", value),
+		)...)
+		return 0
+	}
+
+	return n
+}
+
+// byPriority returns the matched candidates of the lowest priority value
+// among the healthy ones, like SRV records. The others are fallbacks, e.g. a
+// maintenance container, which only receive traffic when no candidate of a
+// lower value is healthy.
+func byPriority(matched []candidate) []candidate {
+	if len(matched) < 2 {
+		return matched
+	}
+
+	best, found := 0, false
+	for _, c := range matched {
+		if c.health == types.Unhealthy || !c.upstream.Healthy() {
+			continue
+		}
+		if !found || c.priority < best {
+			best, found = c.priority, true
+		}
+	}
+
+	// Leave the failure to the reverse proxy if none is healthy.
+	if !found {
+		best = matched[0].priority
+		for _, c := range matched {
+			if c.priority < best {
+				best = c.priority
+			}
+		}
+	}
+
+	kept := make([]candidate, 0, len(matched))
+	for _, c := range matched {
+		if c.priority == best {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,127 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultProbeFailures = 3
+	probeDialTimeout     = time.Second
+)
+
+// probeTarget is a candidate to dial.
+type probeTarget struct {
+	network, address, name string
+}
+
+// probe dials the candidates of the instance every ProbeInterval, and
+// quarantines the ones failing ProbeFailures consecutive probes until a probe
+// succeeds again. It catches the containers which are running but whose
+// process doesn't accept connections anymore.
+func (i *instance) probe(ctx context.Context) {
+	failures := make(map[string]int)
+
+	for {
+		interval, probeFailures, logger := i.settings()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		targets := i.probeTargets()
+
+		var wg sync.WaitGroup
+		failed := make([]bool, len(targets))
+		for j, target := range targets {
+			wg.Add(1)
+			go func(j int, target probeTarget) {
+				defer wg.Done()
+				dialer := net.Dialer{Timeout: probeDialTimeout}
+				conn, err := dialer.DialContext(ctx, target.network, target.address)
+				if err != nil {
+					failed[j] = true
+					return
+				}
+				conn.Close()
+			}(j, target)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		current := make(map[string]struct{}, len(targets))
+		i.checksMu.Lock()
+		quarantined := i.quarantined
+		for j, target := range targets {
+			current[target.address] = struct{}{}
+			_, wasQuarantined := quarantined[target.address]
+
+			if !failed[j] {
+				delete(failures, target.address)
+				if wasQuarantined {
+					delete(quarantined, target.address)
+					logger.Info("upstream passes probe again",
+						zap.String("container_name", target.name),
+						zap.String("address", target.address),
+					)
+				}
+				continue
+			}
+
+			failures[target.address]++
+			if !wasQuarantined && failures[target.address] >= probeFailures {
+				quarantined[target.address] = struct{}{}
+				logger.Warn("quarantine upstream failing probes",
+					zap.String("container_name", target.name),
+					zap.String("address", target.address),
+					zap.Int("failures", failures[target.address]),
+				)
+			}
+		}
+
+		// Forget the candidates which are gone.
+		for address := range quarantined {
+			if _, ok := current[address]; !ok {
+				delete(quarantined, address)
+			}
+		}
+		for address := range failures {
+			if _, ok := current[address]; !ok {
+				delete(failures, address)
+			}
+		}
+		metrics.quarantined.WithLabelValues(i.name).Set(float64(len(quarantined)))
+		i.checksMu.Unlock()
+	}
+}
+
+// probeTargets returns the distinct addresses of the candidates of the
+// instance.
+func (i *instance) probeTargets() []probeTarget {
+	candidates := i.loadSnapshot().candidates
+
+	seen := make(map[string]struct{}, len(candidates))
+	targets := make([]probeTarget, 0, len(candidates))
+	for _, c := range candidates {
+		if _, ok := seen[c.address]; ok {
+			continue
+		}
+		seen[c.address] = struct{}{}
+
+		network := "tcp"
+		if strings.HasPrefix(c.upstream.Dial, "unix/") {
+			network = "unix"
+		}
+		targets = append(targets, probeTarget{network: network, address: c.address, name: c.name})
+	}
+	return targets
+}
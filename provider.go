@@ -0,0 +1,241 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/bep/debounce"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// providersNamespace is the module namespace of the providers.
+const providersNamespace = "http.reverse_proxy.upstreams.docker.providers"
+
+// Provider is a third-party source of upstreams, registered as a module in
+// the http.reverse_proxy.upstreams.docker.providers namespace. Its targets
+// are configured by labels like the containers.
+type Provider interface {
+	// List returns the current targets of the provider.
+	List(ctx context.Context) ([]Target, error)
+	// Watch calls notify whenever the targets may have changed, until ctx is
+	// done. Providers which can't be watched return an error right away, and
+	// are listed every resync interval instead. The watch of a Pinger is
+	// started again once it answers.
+	Watch(ctx context.Context, notify func()) error
+}
+
+// Target is an upstream of a provider.
+type Target struct {
+	// ID identifies the target, e.g. a container id.
+	ID string
+	// Name is the name of the target in logs and placeholders.
+	Name string
+	// Address is the host to dial, the port is the upstream.port label
+	// unless it is `<host>:<port>`.
+	Address string
+	// Labels configure the target like the labels of a container.
+	Labels map[string]string
+	// Kind and Object name the object the labels are read from in the
+	// errors of the labels, e.g. the service of several targets which is
+	// checked once. Default to target and Name.
+	Kind   string
+	Object string
+	// Placeholders are expanded in the labels, like the target ones.
+	Placeholders map[string]string
+	// Ports are the ports of the target by name, either port names or
+	// numbers, which the upstream.port label may name. They are detected
+	// with AutoDetectPort if the label is absent.
+	Ports map[string]int
+}
+
+// Pinger is implemented by the providers which can check they are reachable.
+// Their watch is started again once they answer, instead of polling them.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// builtinProviders create the providers of the endpoints for the Provider
+// option, and return the host they connect to.
+var builtinProviders = map[string]func(u *Upstreams, config Endpoint) (Provider, string, error){
+	ProviderNomad:      newNomadProvider,
+	ProviderKubernetes: newKubeProvider,
+	ProviderContainerd: newCRIProvider,
+}
+
+// listProvider lists the targets of the provider endpoint, with their labels
+// read.
+func (u *Upstreams) listProvider(ctx context.Context, e *endpoint) error {
+	targets, err := e.provider.List(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get the list of targets: %w", err)
+	}
+
+	for i := range targets {
+		targets[i].Labels = u.readLabels(targets[i].Labels, zap.String("target_id", targets[i].ID))
+	}
+
+	e.targets = targets
+	return nil
+}
+
+func (u *Upstreams) appendProviderCandidates(ctx caddy.Context, updated []candidate, e *endpoint, used map[string]*lbPolicy) []candidate {
+	for _, target := range e.targets {
+		placeholders := targetPlaceholders(target)
+		for key, value := range target.Placeholders {
+			placeholders[key] = value
+		}
+		labels := expandLabels(target.Labels, placeholders)
+
+		// Check enable.
+		if enable, ok := labels[LabelEnable]; !ok || enable != "true" || !hasLabels(labels, u.FilterLabel) {
+			continue
+		}
+
+		// Build matchers and metadata.
+		c := u.provisionCandidate(ctx, labels, used, zap.String("target_id", target.ID))
+
+		// Build upstream.
+		address := target.Address
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			port, ok := u.targetPort(target, labels)
+			if !ok {
+				u.logger.Error("unable to get port from target labels",
+					zap.String("target_id", target.ID),
+					zap.Bool("auto_detect_port", u.AutoDetectPort),
+				)
+				continue
+			}
+			address = net.JoinHostPort(address, port)
+		}
+
+		c.endpoint = e.name
+		c.id = target.ID
+		c.name = target.Name
+		c.address = address
+		c.upstream = &reverseproxy.Upstream{Dial: address, MaxRequests: c.maxRequests}
+
+		updated = append(updated, c)
+	}
+
+	return updated
+}
+
+// targetPort returns the port of the target to dial. The upstream.port label
+// is either a port number or one of the ports of the target, which are
+// detected if the label is absent and auto detection is enabled.
+func (u *Upstreams) targetPort(target Target, labels map[string]string) (string, bool) {
+	value, ok := labels[LabelUpstreamPort]
+	if !ok {
+		if !u.AutoDetectPort || len(target.Ports) == 0 {
+			return "", false
+		}
+		ports := make(map[int]string, len(target.Ports))
+		for name, port := range target.Ports {
+			if _, err := strconv.Atoi(name); err != nil {
+				ports[port] = name
+			} else if _, ok := ports[port]; !ok {
+				ports[port] = ""
+			}
+		}
+		return u.detectPort(ports, zap.String("target_id", target.ID))
+	}
+
+	if port, ok := target.Ports[value]; ok {
+		return strconv.Itoa(port), true
+	}
+	if _, err := strconv.Atoi(value); err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+// targetPlaceholders returns the placeholders of the target labels.
+func targetPlaceholders(target Target) map[string]string {
+	return map[string]string{
+		"target.name":     target.Name,
+		"target.id":       target.ID,
+		"target.id.short": shortID(target.ID),
+	}
+}
+
+// watchProvider refreshes the candidates whenever the provider notifies a
+// change, and every ResyncInterval.
+func (u *Upstreams) watchProvider(ctx caddy.Context, e *endpoint) {
+	debounced := debounce.New(time.Duration(u.Debounce))
+
+	refresh := func() {
+		err := u.refresh(ctx, e)
+		if err != nil {
+			metrics.apiErrors.WithLabelValues(e.name).Inc()
+			u.logger.Error("unable to refresh candidates",
+				zap.String("endpoint", e.name),
+				zap.Error(err),
+			)
+			e.scheduleUpdate(refreshRetryInterval, "")
+		}
+	}
+
+	notify := func() {
+		select {
+		case e.wakeup <- struct{}{}:
+		default:
+		}
+	}
+
+	watched := make(chan error, 1)
+	go func() { watched <- e.provider.Watch(ctx, notify) }()
+
+	metrics.streamUp.WithLabelValues(e.name).Set(1)
+
+	var resync <-chan time.Time
+	if u.ResyncInterval > 0 {
+		ticker := time.NewTicker(time.Duration(u.ResyncInterval))
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.wakeup:
+			debounced(refresh)
+		case <-resync:
+			debounced(refresh)
+		case err := <-watched:
+			if ctx.Err() != nil {
+				return
+			}
+			if _, ok := e.provider.(Pinger); ok {
+				metrics.apiErrors.WithLabelValues(e.name).Inc()
+				u.logger.Warn("unable to watch provider; will retry",
+					zap.String("endpoint", e.name),
+					zap.Error(err),
+				)
+				if !u.waitDaemon(ctx, e) {
+					return
+				}
+				metrics.reconnects.WithLabelValues(e.name).Inc()
+				// The changes missed while reconnecting are listed.
+				debounced(refresh)
+				go func() { watched <- e.provider.Watch(ctx, notify) }()
+				continue
+			}
+			metrics.streamUp.WithLabelValues(e.name).Set(0)
+			u.logger.Warn("unable to watch provider; polling instead",
+				zap.String("endpoint", e.name),
+				zap.Error(err),
+			)
+			if resync == nil {
+				ticker := time.NewTicker(defaultPollInterval)
+				defer ticker.Stop()
+				resync = ticker.C
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"go.uber.org/zap"
+)
+
+// notProvider is a module of the providers namespace which is not a
+// Provider.
+type notProvider struct{}
+
+func (notProvider) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  providersNamespace + ".not_provider",
+		New: func() caddy.Module { return new(notProvider) },
+	}
+}
+
+func init() {
+	caddy.RegisterModule(notProvider{})
+}
+
+func TestProvisionNotProvider(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	u := &Upstreams{
+		Instance:     "test-not-provider",
+		ProvidersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(notProvider{}, "provider", "not_provider", nil)},
+	}
+	defer func() {
+		instancesMu.Lock()
+		delete(instances, u.Instance)
+		instancesMu.Unlock()
+	}()
+
+	err := u.Provision(ctx)
+	if err == nil || !strings.Contains(err.Error(), "is not a Provider") {
+		t.Fatalf("Provision() error = %v, want not a Provider", err)
+	}
+}
+
+func TestTargetPort(t *testing.T) {
+	u := &Upstreams{logger: zap.NewNop()}
+	named := Target{Ports: map[string]int{"http": 8080, "80": 8080, "metrics": 9090}}
+
+	tests := []struct {
+		name   string
+		target Target
+		labels map[string]string
+		detect bool
+		port   string
+		ok     bool
+	}{
+		{name: "number", target: Target{}, labels: map[string]string{LabelUpstreamPort: "80"}, port: "80", ok: true},
+		{name: "not a number", target: Target{}, labels: map[string]string{LabelUpstreamPort: "http"}, ok: false},
+		{name: "port name", target: named, labels: map[string]string{LabelUpstreamPort: "http"}, port: "8080", ok: true},
+		{name: "aliased number", target: named, labels: map[string]string{LabelUpstreamPort: "80"}, port: "8080", ok: true},
+		{name: "target port number", target: named, labels: map[string]string{LabelUpstreamPort: "9090"}, port: "9090", ok: true},
+		{name: "no label", target: named, labels: map[string]string{}, ok: false},
+		{name: "detected", target: named, labels: map[string]string{}, detect: true, port: "8080", ok: true},
+	}
+
+	for _, tt := range tests {
+		u.AutoDetectPort = tt.detect
+		port, ok := u.targetPort(tt.target, tt.labels)
+		if port != tt.port || ok != tt.ok {
+			t.Errorf("%s: targetPort() = %q, %v, want %q, %v", tt.name, port, ok, tt.port, tt.ok)
+		}
+	}
+}
+
+func TestKubePorts(t *testing.T) {
+	var service kubeService
+	service.Spec.Ports = []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	}{{Name: "http", Port: 80}, {Name: "dns", Port: 53}}
+
+	var slice kubeEndpointSlice
+	slice.Ports = []struct {
+		Name     string `json:"name"`
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+	}{{Name: "http", Port: 8080, Protocol: "TCP"}, {Name: "dns", Port: 5353, Protocol: "UDP"}, {Port: 9090}}
+
+	got := kubePorts(service, slice)
+	want := map[string]int{"http": 8080, "80": 8080, "9090": 9090}
+	if len(got) != len(want) {
+		t.Fatalf("kubePorts() = %v, want %v", got, want)
+	}
+	for name, port := range want {
+		if got[name] != port {
+			t.Errorf("kubePorts()[%s] = %d, want %d", name, got[name], port)
+		}
+	}
+}
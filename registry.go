@@ -0,0 +1,94 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// UpstreamInfo describes a discovered upstream, for the other modules to
+// know which container serves a host or a request.
+type UpstreamInfo struct {
+	Instance      string
+	Endpoint      string
+	ContainerID   string
+	ContainerName string
+	// Upstream is the name of the upstream of a container declaring several
+	// ones, empty otherwise.
+	Upstream string
+	// Address is the dial address of the upstream.
+	Address string
+	Group   string
+	// Mirror reports whether the upstream only receives mirrored requests.
+	Mirror bool
+	Labels map[string]string
+}
+
+func newUpstreamInfo(c candidate) UpstreamInfo {
+	labels := make(map[string]string, len(c.labels))
+	for key, value := range c.labels {
+		labels[key] = value
+	}
+
+	return UpstreamInfo{
+		Instance:      c.instance,
+		Endpoint:      c.endpoint,
+		ContainerID:   c.id,
+		ContainerName: c.name,
+		Upstream:      c.upstreamName,
+		Address:       c.address,
+		Group:         c.deployGroup,
+		Mirror:        c.mirror,
+		Labels:        labels,
+	}
+}
+
+// LookupHost returns the upstreams of every instance whose host matcher label
+// matches the host. The upstreams without host label aren't returned.
+func LookupHost(host string) []UpstreamInfo {
+	req := &http.Request{Host: strings.ToLower(host), URL: &url.URL{Path: "/"}, Header: http.Header{}}
+	req = req.WithContext(context.WithValue(context.Background(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+
+	var infos []UpstreamInfo
+	for _, s := range loadSnapshots() {
+		for _, c := range s.candidates {
+			if hostLabelMatch(c, req) {
+				infos = append(infos, newUpstreamInfo(c))
+			}
+		}
+	}
+	return infos
+}
+
+// hostLabelMatch reports whether a host matcher label of the candidate
+// matches the host of req.
+func hostLabelMatch(c candidate, req *http.Request) bool {
+	for key, value := range c.labels {
+		if _, ungrouped, _ := matcherGroup(key); ungrouped != LabelMatchHost {
+			continue
+		}
+		if caddyhttp.MatchHost(splitValues(value)).Match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupRequest returns the upstreams of every instance whose matchers match
+// r, regardless of their health and deployment group. r must be a request
+// served by Caddy, whose context holds the replacer.
+func LookupRequest(r *http.Request) []UpstreamInfo {
+	var infos []UpstreamInfo
+	for _, s := range loadSnapshots() {
+		for _, i := range s.hosts.lookup(r) {
+			if c := s.candidates[i]; c.matchers.AnyMatch(r) {
+				infos = append(infos, newUpstreamInfo(c))
+			}
+		}
+	}
+	return infos
+}
@@ -0,0 +1,21 @@
+package caddy_docker_upstreams
+
+import "testing"
+
+func TestLookupHost(t *testing.T) {
+	d := newFakeDaemon(t,
+		fakeContainer("web", "172.17.0.2", map[string]string{LabelMatchHost: "example.com"}),
+		fakeContainer("api", "172.17.0.3", map[string]string{LabelMatchHost: "api.example.com"}),
+		fakeContainer("any", "172.17.0.4", nil),
+	)
+	u := d.provision(0)
+	waitCandidates(t, u, func(candidates []candidate) bool { return len(candidates) == 3 })
+
+	infos := LookupHost("Example.com")
+	if len(infos) != 1 || infos[0].ContainerID != "web" {
+		t.Fatalf("LookupHost() = %v, want the container of the host label", infos)
+	}
+	if infos := LookupHost("other.example.com"); len(infos) != 0 {
+		t.Errorf("LookupHost() = %v, want none", infos)
+	}
+}
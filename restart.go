@@ -0,0 +1,70 @@
+package caddy_docker_upstreams
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// restartKey identifies a container of an endpoint.
+type restartKey struct {
+	endpoint, id string
+}
+
+// setRestarting records the time the container stopped at, unless it is
+// already stopped.
+func (e *endpoint) setRestarting(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.restarting == nil {
+		e.restarting = make(map[string]time.Time)
+	}
+	if _, ok := e.restarting[id]; !ok {
+		e.restarting[id] = time.Now()
+	}
+}
+
+// keepRestarted keeps the previous candidates of the containers stopped for
+// less than TolerateRestarts, e.g. while they are restarted in place, until
+// they are candidates again.
+func (u *Upstreams) keepRestarted(previous, updated []candidate) []candidate {
+	present := make(map[restartKey]struct{})
+	for _, c := range updated {
+		present[restartKey{c.endpoint, c.id}] = struct{}{}
+	}
+
+	timeout := time.Duration(u.TolerateRestarts)
+	tolerated := make(map[restartKey]struct{})
+	for _, e := range u.endpoints {
+		e.mu.Lock()
+		for id, since := range e.restarting {
+			key := restartKey{e.name, id}
+			if _, ok := present[key]; ok || time.Since(since) >= timeout {
+				delete(e.restarting, id)
+				continue
+			}
+			// The containers restarting in a loop are quarantined.
+			if l, ok := e.crashLoops[id]; ok && time.Now().Before(l.until) {
+				continue
+			}
+			tolerated[key] = struct{}{}
+		}
+		e.mu.Unlock()
+	}
+
+	for _, c := range previous {
+		key := restartKey{c.endpoint, c.id}
+		if _, ok := tolerated[key]; !ok {
+			continue
+		}
+
+		u.logger.Debug("keep container while it restarts",
+			zap.String("endpoint", c.endpoint),
+			zap.String("container_name", c.name),
+		)
+		updated = append(updated, c)
+	}
+
+	return updated
+}
@@ -0,0 +1,124 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"go.uber.org/zap"
+)
+
+// containerIDPattern matches the id of the container in the source of the
+// files docker mounts into it, e.g. /var/lib/docker/containers/<id>/hostname.
+var containerIDPattern = regexp.MustCompile(`containers/([0-9a-f]{64})/`)
+
+// containerMounts are the mount points of the files docker mounts from the
+// directory of the container.
+var containerMounts = map[string]struct{}{
+	"/etc/hostname":    {},
+	"/etc/resolv.conf": {},
+}
+
+var errNotInContainer = errors.New("not in a container")
+
+// selfContainerID returns the id of the container Caddy runs in, read from
+// its mounts.
+func selfContainerID() (string, error) {
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	if id, ok := mountinfoContainerID(string(mountinfo)); ok {
+		return id, nil
+	}
+	return "", errNotInContainer
+}
+
+// mountinfoContainerID returns the id of the container in the root of the
+// /etc/hostname or /etc/resolv.conf mount of the mountinfo, the other mounts
+// possibly being the directories of other containers when Caddy runs on the
+// host.
+func mountinfoContainerID(mountinfo string) (string, bool) {
+	for _, line := range strings.Split(mountinfo, "\n") {
+		// The 4th field is the root of the mount, the 5th its mount point.
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		if _, ok := containerMounts[fields[4]]; !ok {
+			continue
+		}
+		if match := containerIDPattern.FindStringSubmatch(fields[3]); match != nil {
+			return match[1], true
+		}
+	}
+	return "", false
+}
+
+// inspectCaddyNetworks sets the networks of the container Caddy runs in, by
+// id and name, to only dial the containers on them. They are left unset if
+// Caddy doesn't run in a container of the endpoint, which is only warned
+// about once.
+func (u *Upstreams) inspectCaddyNetworks(ctx context.Context, e *endpoint) {
+	log := u.logger.Warn
+	if e.caddyNetworksWarned {
+		log = u.logger.Debug
+	}
+
+	id, err := selfContainerID()
+	if err != nil {
+		log("unable to get the container of caddy",
+			zap.String("endpoint", e.name),
+			zap.Error(err),
+		)
+		e.caddyNetworksWarned = true
+		return
+	}
+
+	inspectCtx, cancel := e.apiContext(ctx)
+	defer cancel()
+
+	var inspected types.ContainerJSON
+	if err = e.throttle(inspectCtx); err == nil {
+		inspected, err = e.cli.ContainerInspect(inspectCtx, id)
+	}
+	if err != nil || inspected.NetworkSettings == nil {
+		log("unable to inspect the container of caddy",
+			zap.String("endpoint", e.name),
+			zap.String("container_id", id),
+			zap.Error(err),
+		)
+		e.caddyNetworksWarned = true
+		return
+	}
+
+	networks := make(map[string]struct{}, 2*len(inspected.NetworkSettings.Networks))
+	for name, settings := range inspected.NetworkSettings.Networks {
+		networks[name] = struct{}{}
+		if settings != nil && settings.NetworkID != "" {
+			networks[settings.NetworkID] = struct{}{}
+		}
+	}
+	e.caddyNetworks = networks
+}
+
+// isSelf reports whether the container is the one Caddy runs in.
+func (u *Upstreams) isSelf(id string) bool {
+	return u.selfID != "" && u.selfID == id
+}
+
+// onCaddyNetwork reports whether the network, by name and id, is a network of
+// the container Caddy runs in, or if the networks of Caddy are unknown.
+func (e *endpoint) onCaddyNetwork(name, id string) bool {
+	if e.caddyNetworks == nil {
+		return true
+	}
+	if _, ok := e.caddyNetworks[name]; ok {
+		return true
+	}
+	_, ok := e.caddyNetworks[id]
+	return ok && id != ""
+}
@@ -0,0 +1,51 @@
+package caddy_docker_upstreams
+
+import "testing"
+
+func TestMountinfoContainerID(t *testing.T) {
+	const (
+		selfID  = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+		otherID = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	)
+
+	tests := []struct {
+		name      string
+		mountinfo string
+		id        string
+		ok        bool
+	}{
+		{
+			name: "container",
+			mountinfo: "1 0 0:1 / / rw - overlay overlay rw\n" +
+				"2 1 8:1 /var/lib/docker/containers/" + selfID + "/resolv.conf /etc/resolv.conf rw - ext4 /dev/sda1 rw\n" +
+				"3 1 8:1 /var/lib/docker/containers/" + selfID + "/hostname /etc/hostname rw - ext4 /dev/sda1 rw\n",
+			id: selfID,
+			ok: true,
+		},
+		{
+			name:      "podman",
+			mountinfo: "2 1 8:1 /var/lib/containers/storage/overlay-containers/" + selfID + "/userdata/hostname /etc/hostname rw - ext4 /dev/sda1 rw\n",
+			id:        selfID,
+			ok:        true,
+		},
+		{
+			name: "host",
+			mountinfo: "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n" +
+				"2 1 0:2 / /var/lib/docker/containers/" + otherID + "/mounts/shm rw - tmpfs shm rw\n",
+		},
+		{
+			name:      "other mount point",
+			mountinfo: "2 1 8:1 /var/lib/docker/containers/" + otherID + "/hostname /mnt/hostname rw - ext4 /dev/sda1 rw\n",
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, tt := range tests {
+		id, ok := mountinfoContainerID(tt.mountinfo)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("%s: mountinfoContainerID() = %q, %v, want %q, %v", tt.name, id, ok, tt.id, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"go.uber.org/zap"
+)
+
+const (
+	// APIPing is the /_ping endpoint, the connection is checked by listing
+	// a container instead.
+	APIPing = "ping"
+	// APIEvents is the /events endpoint, the containers are polled every
+	// PollInterval instead.
+	APIEvents = "events"
+)
+
+// disabledAPI reports whether the endpoint of the docker API is disabled.
+func (u *Upstreams) disabledAPI(api string) bool {
+	for _, disabled := range u.DisableAPI {
+		if disabled == api {
+			return true
+		}
+	}
+	return false
+}
+
+// pingDocker checks the daemon answers, by listing a container if the ping
+// endpoint is disabled or forbidden, e.g. by a docker socket proxy.
+func pingDocker(ctx context.Context, cli *client.Client, noPing bool) (types.Ping, error) {
+	if !noPing {
+		ping, err := cli.Ping(ctx)
+		if err == nil || !errdefs.IsForbidden(err) {
+			return ping, err
+		}
+	}
+
+	_, err := cli.ContainerList(ctx, types.ContainerListOptions{Limit: 1})
+	return types.Ping{}, err
+}
+
+// pollDocker lists the containers of the endpoint every PollInterval, in
+// poll mode or for the daemons whose event stream is disabled or forbidden.
+func (u *Upstreams) pollDocker(ctx caddy.Context, e *endpoint) {
+	interval := time.Duration(u.PollInterval)
+	if interval == 0 {
+		interval = time.Duration(u.ResyncInterval)
+	}
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	metrics.streamUp.WithLabelValues(e.name).Set(1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-e.wakeup:
+		}
+
+		e.takeUpdates()
+		err := u.refresh(ctx, e)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			metrics.apiErrors.WithLabelValues(e.name).Inc()
+			u.logger.Warn("unable to list containers; will retry",
+				zap.String("endpoint", e.name),
+				zap.Error(err),
+			)
+			if !u.waitDaemon(ctx, e) {
+				return
+			}
+			metrics.reconnects.WithLabelValues(e.name).Inc()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package caddy_docker_upstreams
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// sshDaemonHost is the host of the API requests sent through ssh, which is
+// never resolved.
+const sshDaemonHost = "http://docker.example.com"
+
+// withSSH connects to the daemon of the ssh:// host through
+// `ssh <host> docker system dial-stdio`, like the docker CLI. The ssh client
+// uses the ssh config and agent of the user running Caddy. Every connection
+// of the client runs its own ssh process, which the http transport keeps
+// alive and replaces once it exits.
+func withSSH(host string) client.Opt {
+	return func(c *client.Client) error {
+		hostURL, err := url.Parse(host)
+		if err != nil {
+			return fmt.Errorf("unable to parse ssh host: %w", err)
+		}
+		if hostURL.Hostname() == "" {
+			return fmt.Errorf("no host in ssh host '%s'", host)
+		}
+
+		var args []string
+		if hostURL.User != nil {
+			args = append(args, "-l", hostURL.User.Username())
+		}
+		if port := hostURL.Port(); port != "" {
+			args = append(args, "-p", port)
+		}
+		args = append(args, "--", hostURL.Hostname(), "docker", "system", "dial-stdio")
+
+		err = client.WithHost(sshDaemonHost)(c)
+		if err != nil {
+			return err
+		}
+		return client.WithDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialCommand("ssh", args...)
+		})(c)
+	}
+}
+
+// isSSHHost reports whether the daemon host is reached through ssh.
+func isSSHHost(host string) bool {
+	return strings.HasPrefix(host, "ssh://")
+}
+
+// sshHostname returns the hostname of the ssh:// host.
+func sshHostname(host string) string {
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return ""
+	}
+	return hostURL.Hostname()
+}
+
+// commandConn is a connection to the stdin and stdout of a command.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr syncBuffer
+
+	closeOnce sync.Once
+}
+
+func dialCommand(name string, args ...string) (net.Conn, error) {
+	conn := &commandConn{cmd: exec.Command(name, args...)}
+	conn.cmd.Stderr = &conn.stderr
+
+	var err error
+	conn.stdin, err = conn.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	conn.stdout, err = conn.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start %s: %w", name, err)
+	}
+	return conn, nil
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		if stderr := strings.TrimSpace(c.stderr.String()); stderr != "" {
+			err = fmt.Errorf("%s exited: %s", c.cmd.Path, stderr)
+		}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.stdin.Close()
+		_ = c.cmd.Process.Kill()
+		_ = c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return dummyAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr { return dummyAddr{} }
+
+// The deadlines are not supported, the requests are bounded by their
+// context instead.
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// syncBuffer is a buffer written by the command while the connection reads
+// it.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "cmd" }
+func (dummyAddr) String() string  { return "cmd" }
+
+// Interface guards
+var (
+	_ net.Conn = (*commandConn)(nil)
+)
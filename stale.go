@@ -0,0 +1,72 @@
+package caddy_docker_upstreams
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// StalePolicyServe keeps providing the stale upstreams, the default.
+	StalePolicyServe = "serve"
+	// StalePolicyFail stops providing the stale upstreams.
+	StalePolicyFail = "fail"
+)
+
+// streamKey identifies an endpoint of an instance.
+type streamKey struct {
+	instance, endpoint string
+}
+
+var (
+	// downEndpoints holds the endpoints whose event stream is down, so their
+	// candidates are not confirmed anymore.
+	downEndpoints   = make(map[streamKey]struct{})
+	downEndpointsMu sync.RWMutex
+)
+
+func setStreamDown(instance, endpoint string, down bool) {
+	downEndpointsMu.Lock()
+	defer downEndpointsMu.Unlock()
+
+	if down {
+		downEndpoints[streamKey{instance, endpoint}] = struct{}{}
+	} else {
+		delete(downEndpoints, streamKey{instance, endpoint})
+	}
+}
+
+// isStale reports whether the candidate was last confirmed more than max ago
+// and the event stream of its endpoint is down.
+func isStale(c candidate, max time.Duration) bool {
+	if time.Since(c.confirmed) <= max {
+		return false
+	}
+
+	downEndpointsMu.RLock()
+	defer downEndpointsMu.RUnlock()
+
+	_, down := downEndpoints[streamKey{c.instance, c.endpoint}]
+	return down
+}
+
+// checkStale reports once the upstreams of the endpoint, whose event stream
+// is down, become older than MaxStaleness. It returns whether they are.
+func (u *Upstreams) checkStale(e *endpoint, reported bool) bool {
+	if reported || u.MaxStaleness == 0 || time.Since(e.confirmed) <= time.Duration(u.MaxStaleness) {
+		return reported
+	}
+
+	policy := u.StalePolicy
+	if policy == "" {
+		policy = StalePolicyServe
+	}
+	u.logger.Warn("upstreams of endpoint are stale",
+		zap.String("endpoint", e.name),
+		zap.Time("confirmed", e.confirmed),
+		zap.String("stale_policy", policy),
+	)
+	metrics.stale.WithLabelValues(e.name).Set(1)
+	return true
+}
@@ -0,0 +1,138 @@
+package caddy_docker_upstreams
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"go.uber.org/zap"
+)
+
+const (
+	startupDialTimeout   = 500 * time.Millisecond
+	startupRetryInterval = 500 * time.Millisecond
+
+	// ipRetryInterval and ipRetryWindow bound the retries of the running
+	// containers having no ip address yet.
+	ipRetryInterval = 250 * time.Millisecond
+	ipRetryWindow   = 10 * time.Second
+)
+
+// startup tracks a container waiting to be ready within the startup delay.
+type startup struct {
+	seen  time.Time
+	ready bool
+	// dialing and accepted are set by the dial of the upstream, which runs
+	// outside of refreshMu.
+	dialing  atomic.Bool
+	accepted atomic.Bool
+}
+
+// ready reports whether the container is ready to receive traffic, that is
+// its healthcheck passes, or it has no healthcheck and the upstream accepts
+// connections. Containers are considered ready once the startup delay is over.
+func (u *Upstreams) ready(e *endpoint, container types.Container, network, address string) bool {
+	s, ok := u.startups[container.ID]
+	if !ok {
+		s = &startup{seen: time.Now()}
+		u.startups[container.ID] = s
+	}
+
+	if s.ready {
+		return true
+	}
+
+	switch containerHealth(container) {
+	case types.Healthy:
+		s.ready = true
+	case types.NoHealthcheck:
+		if s.accepted.Load() {
+			s.ready = true
+		} else if s.dialing.CompareAndSwap(false, true) {
+			go s.dial(e, container.ID, network, address)
+		}
+	}
+
+	if !s.ready && time.Since(s.seen) >= time.Duration(u.StartupDelay) {
+		u.logger.Warn("container is not ready after startup delay",
+			zap.String("container_id", container.ID),
+			zap.String("address", address),
+		)
+		s.ready = true
+	}
+
+	if !s.ready {
+		u.logger.Debug("wait for container to be ready",
+			zap.String("container_id", container.ID),
+			zap.String("address", address),
+		)
+		e.scheduleUpdate(startupRetryInterval, container.ID)
+	}
+
+	return s.ready
+}
+
+// dial checks whether the upstream accepts connections, without holding
+// refreshMu, and updates the container as soon as it does.
+func (s *startup) dial(e *endpoint, id, network, address string) {
+	defer s.dialing.Store(false)
+
+	conn, err := net.DialTimeout(network, address, startupDialTimeout)
+	if err != nil {
+		return
+	}
+	conn.Close()
+	s.accepted.Store(true)
+	e.scheduleUpdate(0, id)
+}
+
+// waitIP reports whether the running container without ip address is listed
+// again shortly, since a container may be started before its network settings
+// are set. It gives up after ipRetryWindow.
+func (u *Upstreams) waitIP(e *endpoint, container types.Container) bool {
+	if container.State != "running" {
+		return false
+	}
+
+	seen, ok := u.noIPs[container.ID]
+	if !ok {
+		seen = time.Now()
+		u.noIPs[container.ID] = seen
+	}
+	if time.Since(seen) >= ipRetryWindow {
+		return false
+	}
+
+	u.logger.Debug("wait for container ip address",
+		zap.String("container_id", container.ID),
+	)
+	e.scheduleUpdate(ipRetryInterval, container.ID)
+	return true
+}
+
+// forgetStartups drops the containers which don't exist anymore.
+func (u *Upstreams) forgetStartups() {
+	exists := make(map[string]struct{})
+	for _, e := range u.endpoints {
+		for _, container := range e.containers {
+			exists[container.ID] = struct{}{}
+		}
+	}
+
+	for id := range u.startups {
+		if _, ok := exists[id]; !ok {
+			delete(u.startups, id)
+		}
+	}
+	for id := range u.noIPs {
+		if _, ok := exists[id]; !ok {
+			delete(u.noIPs, id)
+		}
+	}
+	for id := range u.invalid {
+		if _, ok := exists[id]; !ok {
+			delete(u.invalid, id)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package caddy_docker_upstreams
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types"
+	"go.uber.org/zap"
+)
+
+func TestReadyDialsInBackground(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	u := &Upstreams{
+		StartupDelay: caddy.Duration(time.Hour),
+		logger:       zap.NewNop(),
+		startups:     make(map[string]*startup),
+	}
+	e := &endpoint{wakeup: make(chan struct{}, 1)}
+	container := types.Container{ID: "starting"}
+
+	// The first call doesn't wait for the dial.
+	if u.ready(e, container, "tcp", ln.Addr().String()) {
+		t.Fatal("ready before the upstream was dialed")
+	}
+
+	select {
+	case <-e.wakeup:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update after the upstream accepted the connection")
+	}
+	if ids, _ := e.takeUpdates(); len(ids) != 1 || ids[0] != container.ID {
+		t.Fatalf("updates = %v, want %s", ids, container.ID)
+	}
+	if !u.ready(e, container, "tcp", ln.Addr().String()) {
+		t.Error("not ready after the upstream accepted the connection")
+	}
+}
@@ -0,0 +1,53 @@
+package caddy_docker_upstreams
+
+import "go.uber.org/zap"
+
+// refreshSummary counts the objects of an endpoint through the last
+// rebuild of the candidates.
+type refreshSummary struct {
+	listed     int
+	enabled    int
+	candidates int
+	// skipped counts the enabled objects without candidate by reason, e.g.
+	// `paused` or `unhealthy`.
+	skipped map[string]int
+}
+
+func (s *refreshSummary) skip(reason string) {
+	if s.skipped == nil {
+		s.skipped = make(map[string]int)
+	}
+	s.skipped[reason]++
+}
+
+// equal reports whether the summaries have the same counts.
+func (s refreshSummary) equal(other refreshSummary) bool {
+	if s.listed != other.listed || s.enabled != other.enabled || s.candidates != other.candidates ||
+		len(s.skipped) != len(other.skipped) {
+		return false
+	}
+	for reason, n := range s.skipped {
+		if other.skipped[reason] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// logSummary logs the summary of the endpoint after a full refresh, at the
+// info level when it changed since the last one and at the debug level
+// otherwise. The skipped objects are logged one by one at the debug level.
+func (u *Upstreams) logSummary(e *endpoint) {
+	log := u.logger.Debug
+	if !e.summary.equal(e.logged) {
+		log = u.logger.Info
+		e.logged = e.summary
+	}
+	log("upstreams refreshed",
+		zap.String("endpoint", e.name),
+		zap.Int("listed", e.summary.listed),
+		zap.Int("enabled", e.summary.enabled),
+		zap.Int("candidates", e.summary.candidates),
+		zap.Any("skipped", e.summary.skipped),
+	)
+}
@@ -0,0 +1,45 @@
+package caddy_docker_upstreams
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogSummaryOnChange(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	u := &Upstreams{logger: zap.New(core)}
+	e := &endpoint{name: "local"}
+
+	refresh := func(candidates int, skipped ...string) zapcore.Level {
+		e.summary = refreshSummary{listed: 3, enabled: 3, candidates: candidates}
+		for _, reason := range skipped {
+			e.summary.skip(reason)
+		}
+		u.logSummary(e)
+		entries := logs.TakeAll()
+		if len(entries) != 1 {
+			t.Fatalf("logged %d entries, want 1", len(entries))
+		}
+		return entries[0].Level
+	}
+
+	steps := []struct {
+		candidates int
+		skipped    []string
+		level      zapcore.Level
+	}{
+		{candidates: 2, skipped: []string{"paused"}, level: zapcore.InfoLevel},
+		{candidates: 2, skipped: []string{"paused"}, level: zapcore.DebugLevel},
+		{candidates: 2, skipped: []string{"unhealthy"}, level: zapcore.InfoLevel},
+		{candidates: 3, level: zapcore.InfoLevel},
+		{candidates: 3, level: zapcore.DebugLevel},
+	}
+	for i, step := range steps {
+		if level := refresh(step.candidates, step.skipped...); level != step.level {
+			t.Errorf("refresh %d: logged at %s, want %s", i, level, step.level)
+		}
+	}
+}
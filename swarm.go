@@ -0,0 +1,334 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"go.uber.org/zap"
+)
+
+// swarmUpdateInterval is the interval the tasks are listed at while a service
+// is updating, the task state changes having no events.
+const swarmUpdateInterval = time.Second
+
+const LabelUpstreamSwarmDial = "com.caddyserver.http.upstream.swarm_dial"
+
+const (
+	// SwarmDialTasks dials the ip addresses of the tasks, the default.
+	SwarmDialTasks = "tasks"
+	// SwarmDialVIP dials the virtual ip of the services in vip endpoint
+	// mode, which load balances the tasks.
+	SwarmDialVIP = "vip"
+)
+
+func (u *Upstreams) appendSwarmCandidates(ctx caddy.Context, updated []candidate, e *endpoint, used map[string]*lbPolicy) []candidate {
+	tasksByService := make(map[string][]swarm.Task, len(e.services))
+	for _, task := range e.tasks {
+		tasksByService[task.ServiceID] = append(tasksByService[task.ServiceID], task)
+	}
+
+	for _, service := range e.services {
+		labels := expandLabels(service.Spec.Labels, servicePlaceholders(service))
+
+		// Check enable.
+		if enable, ok := labels[LabelEnable]; !ok || enable != "true" {
+			continue
+		}
+
+		// Check stack.
+		if !u.inProject(labels[stackNamespaceLabel]) {
+			continue
+		}
+
+		for _, named := range namedUpstreams(labels) {
+			updated = u.appendTaskCandidates(ctx, updated, e, used, service, tasksByService[service.ID], named)
+		}
+	}
+
+	return updated
+}
+
+// appendTaskCandidates appends the candidates of the named upstream of the
+// running tasks of the service.
+func (u *Upstreams) appendTaskCandidates(ctx caddy.Context, updated []candidate, e *endpoint, used map[string]*lbPolicy, service swarm.Service, tasks []swarm.Task, named namedUpstream) []candidate {
+	labels := named.labels
+
+	// Build matchers and metadata.
+	c := u.provisionCandidate(ctx, labels, used, zap.String("service_id", service.ID), zap.String("upstream", named.name))
+
+	// Build upstreams.
+	port, ok := u.servicePort(service, labels)
+	if !ok {
+		u.logger.Error("unable to get port from service labels",
+			zap.String("service_id", service.ID),
+			zap.Bool("auto_detect_port", u.AutoDetectPort),
+		)
+		return updated
+	}
+
+	if u.swarmDial(labels) == SwarmDialVIP && !dnsrr(service) {
+		return u.appendVIPCandidate(updated, e, service, tasks, named, c, port)
+	}
+
+	for _, task := range tasks {
+		// The tasks shut down by a rolling update are still running until
+		// they stop, and the new ones are only added once running.
+		if task.DesiredState != swarm.TaskStateRunning || task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+
+		ip, ok := u.taskIPAddress(task, u.network(labels))
+		if !ok {
+			u.logger.Error("unable to get ip address from task networks",
+				zap.String("service_id", service.ID),
+				zap.String("task_id", task.ID),
+				zap.String("network", u.network(labels)),
+			)
+			continue
+		}
+
+		// Dial a placeholder named after the service and the task slot,
+		// so the upstream is the same when the task is replaced, which
+		// keeps hashing policies sticky and the upstream state.
+		c.endpoint = e.name
+		c.id = task.ID
+		c.name = taskName(service, task)
+		c.upstreamName = named.name
+		if named.name != "" {
+			c.name += "." + named.name
+		}
+		c.address = net.JoinHostPort(ip, port)
+		c.placeholder = "http.reverse_proxy.docker.task." + c.name
+		c.upstream = &reverseproxy.Upstream{Dial: "{" + c.placeholder + "}", MaxRequests: c.maxRequests}
+
+		updated = append(updated, c)
+	}
+
+	return updated
+}
+
+// appendVIPCandidate appends the candidate dialing the virtual ip of the
+// service, if it has a running task.
+func (u *Upstreams) appendVIPCandidate(updated []candidate, e *endpoint, service swarm.Service, tasks []swarm.Task, named namedUpstream, c candidate, port string) []candidate {
+	running := false
+	for _, task := range tasks {
+		if task.DesiredState == swarm.TaskStateRunning && task.Status.State == swarm.TaskStateRunning {
+			running = true
+			break
+		}
+	}
+	if !running {
+		return updated
+	}
+
+	ip, ok := u.serviceVIP(service, tasks, u.network(named.labels))
+	if !ok {
+		u.logger.Error("unable to get virtual ip address from service endpoint",
+			zap.String("service_id", service.ID),
+			zap.String("network", u.network(named.labels)),
+		)
+		return updated
+	}
+
+	c.endpoint = e.name
+	c.id = service.ID
+	c.name = service.Spec.Name
+	c.upstreamName = named.name
+	if named.name != "" {
+		c.name += "." + named.name
+	}
+	c.address = net.JoinHostPort(ip, port)
+	c.upstream = &reverseproxy.Upstream{Dial: c.address, MaxRequests: c.maxRequests}
+
+	return append(updated, c)
+}
+
+// swarmDial returns how the upstreams of the service are dialed, the label
+// overriding the SwarmDial option.
+func (u *Upstreams) swarmDial(labels map[string]string) string {
+	if value, ok := labels[LabelUpstreamSwarmDial]; ok {
+		return value
+	}
+	if u.SwarmDial == "" {
+		return SwarmDialTasks
+	}
+	return u.SwarmDial
+}
+
+// dnsrr reports whether the service is in dnsrr endpoint mode, which has no
+// virtual ip.
+func dnsrr(service swarm.Service) bool {
+	if service.Spec.EndpointSpec != nil && service.Spec.EndpointSpec.Mode != "" {
+		return service.Spec.EndpointSpec.Mode == swarm.ResolutionModeDNSRR
+	}
+	return service.Endpoint.Spec.Mode == swarm.ResolutionModeDNSRR
+}
+
+// serviceVIP returns the virtual ip of the service in the named network, or
+// in the first non-ingress network if name is empty. The network names are
+// read from the network attachments of the tasks.
+func (u *Upstreams) serviceVIP(service swarm.Service, tasks []swarm.Task, name string) (string, bool) {
+	networks := make(map[string]swarm.Network)
+	for _, task := range tasks {
+		for _, attachment := range task.NetworksAttachments {
+			networks[attachment.Network.ID] = attachment.Network
+		}
+	}
+
+	var ipv4, ipv6 string
+	for _, vip := range service.Endpoint.VirtualIPs {
+		network, ok := networks[vip.NetworkID]
+		if !ok {
+			continue
+		}
+		if name != "" && network.Spec.Name != name {
+			continue
+		}
+		if name == "" && network.Spec.Ingress {
+			continue
+		}
+
+		// Addresses are in CIDR notation.
+		ip, _, _ := strings.Cut(vip.Addr, "/")
+		switch {
+		case ip == "":
+		case strings.Contains(ip, ":"):
+			if ipv6 == "" {
+				ipv6 = ip
+			}
+		default:
+			if ipv4 == "" {
+				ipv4 = ip
+			}
+		}
+	}
+
+	ip := u.pickIP(ipv4, ipv6)
+	return ip, ip != ""
+}
+
+// servicePort returns the upstream port of the service, or its target tcp
+// port if the label is absent and auto detection is enabled.
+func (u *Upstreams) servicePort(service swarm.Service, labels map[string]string) (string, bool) {
+	if port, ok := labels[LabelUpstreamPort]; ok {
+		return port, true
+	}
+
+	if !u.AutoDetectPort {
+		return "", false
+	}
+
+	targets := make(map[int]string, len(service.Endpoint.Ports))
+	for _, port := range service.Endpoint.Ports {
+		if port.Protocol == swarm.PortConfigProtocolTCP {
+			targets[int(port.TargetPort)] = port.Name
+		}
+	}
+
+	return u.detectPort(targets, zap.String("service_id", service.ID))
+}
+
+// taskName returns the service name with the task slot, or the node id for
+// global services.
+func taskName(service swarm.Service, task swarm.Task) string {
+	if task.Slot == 0 {
+		return service.Spec.Name + "." + task.NodeID
+	}
+	return service.Spec.Name + "." + strconv.Itoa(task.Slot)
+}
+
+// taskIPAddress returns the ip address of task in the named network, or of
+// the first non-ingress network attachment if name is empty.
+func (u *Upstreams) taskIPAddress(task swarm.Task, name string) (string, bool) {
+	for _, attachment := range task.NetworksAttachments {
+		if name != "" && attachment.Network.Spec.Name != name {
+			continue
+		}
+		if name == "" && attachment.Network.Spec.Ingress {
+			continue
+		}
+
+		var ipv4, ipv6 string
+		for _, address := range attachment.Addresses {
+			// Addresses are in CIDR notation.
+			ip, _, _ := strings.Cut(address, "/")
+			switch {
+			case ip == "":
+			case strings.Contains(ip, ":"):
+				if ipv6 == "" {
+					ipv6 = ip
+				}
+			default:
+				if ipv4 == "" {
+					ipv4 = ip
+				}
+			}
+		}
+
+		if ip := u.pickIP(ipv4, ipv6); ip != "" {
+			return ip, true
+		}
+	}
+
+	return "", false
+}
+
+// listSwarm lists the services matching args and the running tasks.
+func (e *endpoint) listSwarm(ctx context.Context, args filters.Args) error {
+	ctx, cancel := e.apiContext(ctx)
+	defer cancel()
+
+	if err := e.throttle(ctx); err != nil {
+		return fmt.Errorf("unable to get the list of services: %w", err)
+	}
+
+	services, err := e.cli.ServiceList(ctx, types.ServiceListOptions{
+		Filters: args,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get the list of services: %w", err)
+	}
+
+	if err := e.throttle(ctx); err != nil {
+		return fmt.Errorf("unable to get the list of tasks: %w", err)
+	}
+	tasks, err := e.cli.TaskList(ctx, types.TaskListOptions{
+		Filters: filters.NewArgs(filters.Arg("desired-state", string(swarm.TaskStateRunning))),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get the list of tasks: %w", err)
+	}
+
+	e.services = services
+	e.tasks = tasks
+
+	// Follow the tasks of the rolling updates in progress.
+	if e.updatingSwarm() {
+		e.scheduleUpdate(swarmUpdateInterval, "")
+	}
+	return nil
+}
+
+// updatingSwarm reports whether a rolling update or rollback of a service is
+// in progress.
+func (e *endpoint) updatingSwarm() bool {
+	for _, service := range e.services {
+		if service.UpdateStatus == nil {
+			continue
+		}
+		switch service.UpdateStatus.State {
+		case swarm.UpdateStateUpdating, swarm.UpdateStateRollbackStarted:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package caddy_docker_upstreams
+
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// shortIDLength is the length of the ids printed by the docker CLI.
+const shortIDLength = 12
+
+// expandLabels returns the labels whose values have the placeholders of
+// values replaced. The other placeholders, like the request placeholders of
+// the expression matcher, are left as is.
+func expandLabels(labels map[string]string, values map[string]string) map[string]string {
+	repl := caddy.NewEmptyReplacer()
+	for key, value := range values {
+		repl.Set(key, value)
+	}
+
+	expanded := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if strings.Contains(value, "{") {
+			value = repl.ReplaceKnown(value, "")
+		}
+		expanded[key] = value
+	}
+	return expanded
+}
+
+// containerPlaceholders returns the placeholders of the container labels,
+// network is the name of the network whose ip address is used.
+func containerPlaceholders(container types.Container, network string) map[string]string {
+	return map[string]string{
+		"container.name":     containerName(container),
+		"container.id":       container.ID,
+		"container.id.short": shortID(container.ID),
+		"network.name":       network,
+	}
+}
+
+// servicePlaceholders returns the placeholders of the service labels.
+func servicePlaceholders(service swarm.Service) map[string]string {
+	return map[string]string{
+		"service.name":     service.Spec.Name,
+		"service.id":       service.ID,
+		"service.id.short": shortID(service.ID),
+	}
+}
+
+func shortID(id string) string {
+	if len(id) > shortIDLength {
+		return id[:shortIDLength]
+	}
+	return id
+}
+
+// renderAddress replaces the placeholders of the address template, which
+// must all be known and not empty.
+func renderAddress(template string, values map[string]string) (string, error) {
+	repl := caddy.NewEmptyReplacer()
+	for key, value := range values {
+		repl.Set(key, value)
+	}
+	return repl.ReplaceOrErr(template, true, true)
+}
+
+// checkAddressTemplate checks the placeholders of the address template are
+// known.
+func checkAddressTemplate(template string) error {
+	repl := caddy.NewEmptyReplacer()
+	for _, key := range addressPlaceholderNames {
+		repl.Set(key, "")
+	}
+	_, err := repl.ReplaceOrErr(template, false, true)
+	return err
+}
+
+var addressPlaceholderNames = []string{"ip", "port", "container_name", "container_id", "network", "service", "host_ip", "host_port"}
+
+// addressPlaceholders returns the placeholders of the address template, the
+// host ones are empty unless the port is published.
+func addressPlaceholders(e *endpoint, container types.Container, network, ip, port string) map[string]string {
+	hostIP, hostPort, _ := publishedBinding(e, container, port)
+	return map[string]string{
+		"ip":             ip,
+		"port":           port,
+		"container_name": containerName(container),
+		"container_id":   container.ID,
+		"network":        network,
+		"service":        container.Labels[composeServiceLabel],
+		"host_ip":        hostIP,
+		"host_port":      hostPort,
+	}
+}
@@ -0,0 +1,28 @@
+package caddy_docker_upstreams
+
+import "strings"
+
+const (
+	LabelTLSIssuer      = "com.caddyserver.http.tls.issuer"
+	LabelTLSDNSProvider = "com.caddyserver.http.tls.dns_provider"
+
+	// The TLS preference follows the prefix, e.g.
+	// com.caddyserver.http.tls.issuer.
+	LabelTLSPrefix = "com.caddyserver.http.tls."
+)
+
+// tlsLabels returns the TLS preferences declared by the labels, by name
+// without the prefix, e.g. issuer. They are metadata only, the certificates
+// are managed by the tls app.
+func tlsLabels(labels map[string]string) map[string]string {
+	var prefs map[string]string
+	for key, value := range labels {
+		if name := strings.TrimPrefix(key, LabelTLSPrefix); name != key && name != "" {
+			if prefs == nil {
+				prefs = make(map[string]string)
+			}
+			prefs[name] = value
+		}
+	}
+	return prefs
+}
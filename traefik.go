@@ -0,0 +1,202 @@
+package caddy_docker_upstreams
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	traefikEnableLabel   = "traefik.enable"
+	traefikNetworkLabel  = "traefik.docker.network"
+	traefikRouterPrefix  = "traefik.http.routers."
+	traefikServicePrefix = "traefik.http.services."
+)
+
+// translateTraefik adds the labels translated from the traefik labels, the
+// labels already set are kept. The rules of the routers are translated to an
+// expression matcher.
+func translateTraefik(labels map[string]string) (map[string]string, error) {
+	translated := make(map[string]string, len(labels))
+	for key, value := range labels {
+		translated[key] = value
+	}
+
+	set := func(key, value string) {
+		if _, ok := translated[key]; !ok && value != "" {
+			translated[key] = value
+		}
+	}
+
+	set(LabelEnable, labels[traefikEnableLabel])
+	set(LabelUpstreamNetwork, labels[traefikNetworkLabel])
+	set(LabelUpstreamPort, traefikValue(labels, traefikServicePrefix, "loadbalancer.server.port"))
+	set(LabelUpstreamScheme, traefikValue(labels, traefikServicePrefix, "loadbalancer.server.scheme"))
+
+	var rules []string
+	for _, rule := range traefikValues(labels, traefikRouterPrefix, "rule") {
+		expr, err := traefikRuleExpression(rule)
+		if err != nil {
+			return translated, fmt.Errorf("unable to translate traefik rule '%s': %w", rule, err)
+		}
+		rules = append(rules, expr)
+	}
+	switch len(rules) {
+	case 0:
+	case 1:
+		set(LabelMatchExpression, rules[0])
+	default:
+		set(LabelMatchExpression, "("+strings.Join(rules, ") || (")+")")
+	}
+
+	return translated, nil
+}
+
+// traefikValues returns the values of the labels `<prefix><name>.<suffix>`
+// sorted by name.
+func traefikValues(labels map[string]string, prefix, suffix string) []string {
+	var names []string
+	for key := range labels {
+		name := strings.TrimPrefix(key, prefix)
+		if name != key && strings.HasSuffix(name, "."+suffix) {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+
+	values := make([]string, 0, len(names))
+	for _, key := range names {
+		values = append(values, labels[key])
+	}
+	return values
+}
+
+// traefikValue returns the first value of traefikValues.
+func traefikValue(labels map[string]string, prefix, suffix string) string {
+	if values := traefikValues(labels, prefix, suffix); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// traefikRuleExpression translates a traefik rule like
+// Host(`a.example.com`) && PathPrefix(`/api`) to a CEL expression using the
+// matcher functions. The operators and parentheses are kept as is.
+func traefikRuleExpression(rule string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(rule); {
+		if !unicode.IsLetter(rune(rule[i])) {
+			b.WriteByte(rule[i])
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(rule) && (unicode.IsLetter(rune(rule[i])) || unicode.IsDigit(rune(rule[i]))) {
+			i++
+		}
+		name := rule[start:i]
+
+		for i < len(rule) && rule[i] == ' ' {
+			i++
+		}
+		if i == len(rule) || rule[i] != '(' {
+			return "", fmt.Errorf("missing arguments of %s", name)
+		}
+
+		args, n, err := traefikArgs(rule[i+1:])
+		if err != nil {
+			return "", err
+		}
+		i += n + 1
+
+		expr, err := traefikMatcher(name, args)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(expr)
+	}
+
+	return b.String(), nil
+}
+
+// traefikArgs parses the quoted arguments up to the closing parenthesis, and
+// returns the number of bytes read.
+func traefikArgs(s string) ([]string, int, error) {
+	var args []string
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', ',':
+		case ')':
+			return args, i + 1, nil
+		case '`', '"', '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, 0, fmt.Errorf("unterminated argument")
+			}
+			args = append(args, s[i+1:i+1+end])
+			i += end + 1
+		default:
+			return nil, 0, fmt.Errorf("unexpected character '%c' in arguments", c)
+		}
+	}
+
+	return nil, 0, fmt.Errorf("missing closing parenthesis")
+}
+
+// traefikMatcher returns the matcher function call of the traefik matcher.
+func traefikMatcher(name string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("missing arguments of %s", name)
+	}
+
+	switch name {
+	case "Host":
+		return celCall("host", args), nil
+	case "Path":
+		return celCall("path", args), nil
+	case "PathPrefix":
+		prefixes := make([]string, 0, len(args))
+		for _, arg := range args {
+			prefixes = append(prefixes, arg+"*")
+		}
+		return celCall("path", prefixes), nil
+	case "PathRegexp":
+		return celCall("path_regexp", args[:1]), nil
+	case "Method":
+		return celCall("method", args), nil
+	case "ClientIP":
+		return celCall("remote_ip", args), nil
+	case "Headers":
+		if len(args) != 2 {
+			return "", fmt.Errorf("%s expects a field and a value", name)
+		}
+		return "header({" + strconv.Quote(args[0]) + ": " + strconv.Quote(args[1]) + "})", nil
+	case "HeadersRegexp":
+		if len(args) != 2 {
+			return "", fmt.Errorf("%s expects a field and a pattern", name)
+		}
+		return celCall("header_regexp", args), nil
+	case "Query":
+		var pairs []string
+		for _, arg := range args {
+			key, value, _ := strings.Cut(arg, "=")
+			pairs = append(pairs, strconv.Quote(key)+": "+strconv.Quote(value))
+		}
+		return "query({" + strings.Join(pairs, ", ") + "})", nil
+	default:
+		return "", fmt.Errorf("unsupported matcher %s", name)
+	}
+}
+
+func celCall(name string, args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, strconv.Quote(arg))
+	}
+	return name + "(" + strings.Join(quoted, ", ") + ")"
+}
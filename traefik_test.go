@@ -0,0 +1,79 @@
+package caddy_docker_upstreams
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTraefikRuleExpression(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+		err  bool
+	}{
+		{rule: "Host(`a.example.com`)", want: `host("a.example.com")`},
+		{rule: "Host(`a.example.com`, `b.example.com`)", want: `host("a.example.com", "b.example.com")`},
+		{rule: "Host(`a.example.com`) && PathPrefix(`/api`)", want: `host("a.example.com") && path("/api*")`},
+		{rule: "(Path(`/a`) || Path(`/b`)) && Method(`GET`)", want: `(path("/a") || path("/b")) && method("GET")`},
+		{rule: "!ClientIP(`10.0.0.0/8`)", want: `!remote_ip("10.0.0.0/8")`},
+		{rule: "PathRegexp(`^/v[0-9]+`)", want: `path_regexp("^/v[0-9]+")`},
+		{rule: "Headers(`X-Tenant`, `acme`)", want: `header({"X-Tenant": "acme"})`},
+		{rule: "HeadersRegexp(`X-Tenant`, `^a`)", want: `header_regexp("X-Tenant", "^a")`},
+		{rule: "Query(`debug=1`, `page=2`)", want: `query({"debug": "1", "page": "2"})`},
+		{rule: "Host (\"a.example.com\")", want: `host("a.example.com")`},
+		{rule: "Host", err: true},
+		{rule: "Host()", err: true},
+		{rule: "Host(`a.example.com`", err: true},
+		{rule: "Host(`a.example.com)", err: true},
+		{rule: "Headers(`X-Tenant`)", err: true},
+		{rule: "HostSNI(`a.example.com`)", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := traefikRuleExpression(tt.rule)
+		if tt.err {
+			if err == nil {
+				t.Errorf("traefikRuleExpression(%q) = %q, want an error", tt.rule, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("traefikRuleExpression(%q) = %q, %v, want %q", tt.rule, got, err, tt.want)
+		}
+	}
+}
+
+func TestTranslateTraefik(t *testing.T) {
+	labels := map[string]string{
+		"traefik.enable":                                       "true",
+		"traefik.docker.network":                               "proxy",
+		"traefik.http.routers.b.rule":                          "Host(`b.example.com`)",
+		"traefik.http.routers.a.rule":                          "Host(`a.example.com`)",
+		"traefik.http.services.web.loadbalancer.server.port":   "8080",
+		"traefik.http.services.web.loadbalancer.server.scheme": "https",
+		LabelUpstreamScheme:                                    "http",
+	}
+
+	got, err := translateTraefik(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]string, len(labels))
+	for key, value := range labels {
+		want[key] = value
+	}
+	want[LabelEnable] = "true"
+	want[LabelUpstreamNetwork] = "proxy"
+	want[LabelUpstreamPort] = "8080"
+	// The module labels take precedence.
+	want[LabelUpstreamScheme] = "http"
+	want[LabelMatchExpression] = `(host("a.example.com")) || (host("b.example.com"))`
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("translateTraefik() = %v, want %v", got, want)
+	}
+
+	if _, err := translateTraefik(map[string]string{"traefik.http.routers.a.rule": "HostSNI(`a`)"}); err == nil {
+		t.Error("translateTraefik() with an unsupported rule, want an error")
+	}
+}
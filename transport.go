@@ -0,0 +1,168 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy/fastcgi"
+)
+
+const (
+	LabelUpstreamScheme                = "com.caddyserver.http.upstream.scheme"
+	LabelUpstreamTLSInsecureSkipVerify = "com.caddyserver.http.upstream.tls_insecure_skip_verify"
+	LabelUpstreamProtocol              = "com.caddyserver.http.upstream.protocol"
+)
+
+const (
+	// ProtocolHTTP speaks HTTP/1.1 or HTTP/2 over TLS, the default.
+	ProtocolHTTP = "http"
+	// ProtocolH2C speaks HTTP/2 over cleartext, e.g. gRPC servers.
+	ProtocolH2C = "h2c"
+	// ProtocolFastCGI speaks FastCGI, e.g. PHP-FPM.
+	ProtocolFastCGI = "fastcgi"
+)
+
+func init() {
+	caddy.RegisterModule(Transport{})
+}
+
+// Transport is an http transport which dials the upstreams provided by the
+// docker upstreams with the scheme and protocol declared by their labels. It
+// accepts the options of the http transport, which are shared by all
+// upstreams. The fastcgi upstreams use the root directive of the site and
+// split the path after .php, like php_fastcgi.
+type Transport struct {
+	reverseproxy.HTTPTransport
+
+	plain    *reverseproxy.HTTPTransport
+	tls      *reverseproxy.HTTPTransport
+	insecure *reverseproxy.HTTPTransport
+	h2c      *reverseproxy.HTTPTransport
+	fastcgi  *fastcgi.Transport
+}
+
+func (Transport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.transport.docker",
+		New: func() caddy.Module { return new(Transport) },
+	}
+}
+
+func (t *Transport) Provision(ctx caddy.Context) error {
+	plain := t.HTTPTransport
+	plain.TLS = nil
+	t.plain = &plain
+
+	tls := t.HTTPTransport
+	tls.TLS = new(reverseproxy.TLSConfig)
+	if t.TLS != nil {
+		*tls.TLS = *t.TLS
+	}
+	t.tls = &tls
+
+	insecure := tls
+	insecure.TLS = new(reverseproxy.TLSConfig)
+	*insecure.TLS = *tls.TLS
+	insecure.TLS.InsecureSkipVerify = true
+	t.insecure = &insecure
+
+	h2c := plain
+	h2c.Versions = []string{"h2c", "2"}
+	t.h2c = &h2c
+
+	for _, transport := range []*reverseproxy.HTTPTransport{&t.HTTPTransport, t.plain, t.tls, t.insecure, t.h2c} {
+		err := transport.Provision(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.fastcgi = &fastcgi.Transport{
+		SplitPath:   []string{".php"},
+		DialTimeout: t.DialTimeout,
+		ReadTimeout: t.ReadTimeout,
+	}
+	return t.fastcgi.Provision(ctx)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport, req := t.transport(req)
+	return transport.RoundTrip(req)
+}
+
+// transport returns the transport matching the labels of the upstream
+// selected for req, and the request with its request headers. The request
+// is copied before setting them, since the reverse proxy retries the other
+// upstreams with the same request.
+func (t *Transport) transport(req *http.Request) (http.RoundTripper, *http.Request) {
+	dialInfo, ok := reverseproxy.GetDialInfo(req.Context())
+	if !ok {
+		return &t.HTTPTransport, req
+	}
+
+	c, ok := lookupCandidate(dialInfo.Address)
+	if !ok {
+		return &t.HTTPTransport, req
+	}
+
+	// The upstream is only known once selected by the reverse proxy.
+	repl, _ := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if repl != nil {
+		c.setPlaceholders(repl)
+	}
+	if len(c.headers) > 0 || c.upstreamHost() != "" {
+		req = req.Clone(req.Context())
+		c.setHeaders(req, repl)
+	}
+
+	return t.transportOf(c), req
+}
+
+// transportOf returns the transport matching the labels of c.
+func (t *Transport) transportOf(c candidate) http.RoundTripper {
+	switch {
+	case c.protocol == ProtocolFastCGI:
+		return t.fastcgi
+	case c.protocol == ProtocolH2C:
+		return t.h2c
+	case c.insecure:
+		return t.insecure
+	case c.scheme == "https":
+		return t.tls
+	case c.scheme == "http":
+		return t.plain
+	default:
+		return &t.HTTPTransport
+	}
+}
+
+// Cleanup closes the idle connections of the transports.
+func (t *Transport) Cleanup() error {
+	for _, transport := range []*reverseproxy.HTTPTransport{&t.HTTPTransport, t.plain, t.tls, t.insecure, t.h2c} {
+		if transport != nil {
+			_ = transport.Cleanup()
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into t, the options are
+// the ones of the http transport.
+//
+//	transport docker {
+//		<http transport options...>
+//	}
+func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return t.HTTPTransport.UnmarshalCaddyfile(d)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Transport)(nil)
+	_ caddy.CleanerUpper    = (*Transport)(nil)
+	_ http.RoundTripper     = (*Transport)(nil)
+	_ caddyfile.Unmarshaler = (*Transport)(nil)
+)
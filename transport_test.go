@@ -0,0 +1,63 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func TestTransportHeadersPerUpstream(t *testing.T) {
+	first := candidate{
+		address:  "10.0.0.1:80",
+		upstream: &reverseproxy.Upstream{Dial: "10.0.0.1:80"},
+		headers:  map[string]string{"X-Container": "first"},
+		host:     "first.internal",
+	}
+	second := candidate{
+		address:  "10.0.0.2:80",
+		upstream: &reverseproxy.Upstream{Dial: "10.0.0.2:80"},
+	}
+
+	i := getInstance("test-transport-headers")
+	i.current.Store(&snapshot{
+		candidates: []candidate{first, second},
+		byDial:     map[string]candidate{first.address: first, second.address: second},
+	})
+	t.Cleanup(func() {
+		instancesMu.Lock()
+		delete(instances, i.name)
+		instancesMu.Unlock()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, make(map[string]any))
+	req = req.WithContext(ctx)
+
+	var transport Transport
+
+	// The first attempt dials the candidate having the labels.
+	caddyhttp.SetVar(ctx, "reverse_proxy.dial_info", reverseproxy.DialInfo{Address: first.address})
+	_, dialed := transport.transport(req)
+	if got := dialed.Header.Get("X-Container"); got != "first" {
+		t.Errorf("first upstream: X-Container = %q, want first", got)
+	}
+	if dialed.Host != "first.internal" {
+		t.Errorf("first upstream: Host = %q, want first.internal", dialed.Host)
+	}
+
+	// The retry on the other candidate doesn't carry them.
+	caddyhttp.SetVar(ctx, "reverse_proxy.dial_info", reverseproxy.DialInfo{Address: second.address})
+	_, dialed = transport.transport(req)
+	if got := dialed.Header.Get("X-Container"); got != "" {
+		t.Errorf("second upstream: X-Container = %q, want none", got)
+	}
+	if dialed.Host != "example.com" {
+		t.Errorf("second upstream: Host = %q, want example.com", dialed.Host)
+	}
+}
@@ -2,28 +2,100 @@ package caddy_docker_upstreams
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/bep/debounce"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"go.uber.org/zap"
 )
 
 const (
-	LabelEnable       = "com.caddyserver.http.enable"
-	LabelUpstreamPort = "com.caddyserver.http.upstream.port"
-	LabelHealthCheck  = "com.caddyserver.http.healthcheck"
+	LabelEnable              = "com.caddyserver.http.enable"
+	LabelUpstreamPort        = "com.caddyserver.http.upstream.port"
+	LabelUpstreamNetwork     = "com.caddyserver.http.upstream.network"
+	LabelUpstreamPublished   = "com.caddyserver.http.upstream.published"
+	LabelUpstreamWeight      = "com.caddyserver.http.upstream.weight"
+	LabelUpstreamMaxRequests = "com.caddyserver.http.upstream.max_requests"
+	LabelUpstreamSocket      = "com.caddyserver.http.upstream.socket"
+	LabelHealthCheck         = "com.caddyserver.http.healthcheck"
+	LabelFallback            = "com.caddyserver.http.fallback"
+)
+
+const (
+	// ProviderDocker connects to the docker engine.
+	ProviderDocker = "docker"
+	// ProviderPodman connects to the docker compatible API of podman.
+	ProviderPodman = "podman"
+	// ProviderNomad discovers upstreams from the services of the Nomad
+	// agent, configured with tags instead of labels.
+	ProviderNomad = "nomad"
+	// ProviderKubernetes discovers upstreams from the endpoint slices of the
+	// Kubernetes services, configured with annotations instead of labels.
+	ProviderKubernetes = "kubernetes"
+	// ProviderContainerd discovers upstreams from the pods of the CRI
+	// runtime service of containerd, without docker.
+	ProviderContainerd = "containerd"
+)
+
+const (
+	// ModeContainer discovers upstreams from the containers of the docker host.
+	ModeContainer = "container"
+	// ModeSwarm discovers upstreams from the tasks of the swarm services.
+	ModeSwarm = "swarm"
+	// ModePoll discovers upstreams from the containers like ModeContainer,
+	// listing them every PollInterval instead of following the events.
+	ModePoll = "poll"
+)
+
+const defaultDebounce = 100 * time.Millisecond
+
+const defaultAPITimeout = 30 * time.Second
+
+// refreshRetryInterval is the delay before retrying a failed refresh.
+const refreshRetryInterval = time.Second
+
+// defaultLabelPrefix is the prefix of the label constants.
+const defaultLabelPrefix = "com.caddyserver.http"
+
+const (
+	// IPVersionPreferIPv4 dials the ipv4 address if any, the default.
+	IPVersionPreferIPv4 = "prefer_ipv4"
+	// IPVersionPreferIPv6 dials the ipv6 address if any.
+	IPVersionPreferIPv6 = "prefer_ipv6"
+	// IPVersionIPv4Only only dials ipv4 addresses.
+	IPVersionIPv4Only = "ipv4_only"
+	// IPVersionIPv6Only only dials ipv6 addresses.
+	IPVersionIPv6Only = "ipv6_only"
+)
+
+const (
+	// DialNameContainer dials the container name.
+	DialNameContainer = "container"
+	// DialNameService dials the compose service name.
+	DialNameService = "service"
+)
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	stackNamespaceLabel = "com.docker.stack.namespace"
 )
 
 func init() {
@@ -31,18 +103,322 @@ func init() {
 }
 
 type candidate struct {
-	matchers caddyhttp.MatcherSet
-	upstream *reverseproxy.Upstream
+	// instance is the Instance of the module which discovered the
+	// candidate.
+	instance string
+	endpoint string
+	// id is the id of the container, or of the task in swarm mode.
+	id   string
+	name string
+	// upstreamName is the name of the upstream of a container declaring
+	// several ones, see namedUpstreams.
+	upstreamName string
+	labels       map[string]string
+	health       string
+	// deployGroup is the blue/green deployment group of the container,
+	// which only receives traffic while the group is active.
+	deployGroup string
+	matchers    caddyhttp.MatcherSets
+	upstream    *reverseproxy.Upstream
+	// address is the dial address of upstream, whose Dial may be a
+	// placeholder set to address when getting upstreams.
+	address     string
+	placeholder string
+	group       string
+	policy      *lbPolicy
+	scheme      string
+	insecure    bool
+	protocol    string
+	// weight is the number of times upstream is repeated in the pool of
+	// the selection policies.
+	weight int
+	// maxRequests caps the concurrent requests of upstream, zero leaves the
+	// limit to the passive health checks.
+	maxRequests int
+	// headers are the request headers set on the requests proxied to
+	// upstream.
+	headers map[string]string
+	// host is the value of the host label, see upstreamHost.
+	host string
+	// confirmed is the time the object of the candidate was last listed.
+	confirmed time.Time
+	// priority orders the candidates matching a request, the ones of the
+	// lowest value receive the traffic while any is healthy.
+	priority int
+	// fallback candidates only receive the requests which no other
+	// candidate matches.
+	fallback bool
+	// mirror candidates never receive the requests, see LookupMirrors.
+	mirror bool
+	// tls holds the TLS preferences of the tls labels, see tlsLabels.
+	tls map[string]string
 }
 
-var (
-	candidates   []candidate
-	candidatesMu sync.RWMutex
-)
+// setPlaceholders sets the placeholders identifying the container of c.
+func (c candidate) setPlaceholders(repl *caddy.Replacer) {
+	repl.Set("http.reverse_proxy.docker.endpoint", c.endpoint)
+	repl.Set("http.reverse_proxy.docker.container_id", c.id)
+	repl.Set("http.reverse_proxy.docker.container_name", c.name)
+	repl.Set("http.reverse_proxy.docker.upstream_host", c.upstreamHost())
+}
+
+// appendUpstream appends the upstream of c to pool as many times as its
+// weight.
+func (c candidate) appendUpstream(pool []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	for i := 0; i < c.weight; i++ {
+		pool = append(pool, c.upstream)
+	}
+	return pool
+}
+
+// snapshot holds the candidates of a refresh and their indexes, it is never
+// modified once published so requests read it without locking.
+type snapshot struct {
+	candidates []candidate
+	// byDial indexes the candidates by dial address.
+	byDial map[string]candidate
+	// hosts indexes the candidates by the exact hosts of their host
+	// matcher.
+	hosts candidateIndex
+	// groups holds whether the deployment groups are active by the
+	// group.active label of their containers.
+	groups map[string]bool
+	// refreshed is the time the candidates were rebuilt.
+	refreshed time.Time
+}
+
+// refreshMu serializes the refreshes of candidates.
+var refreshMu sync.Mutex
 
 // Upstreams provides upstreams from the docker host.
 type Upstreams struct {
-	logger *zap.Logger
+	// Host is the address of the docker daemon, e.g. unix:///var/run/docker.sock
+	// or tcp://10.0.0.1:2376. Defaults to DOCKER_HOST or the platform default.
+	Host string `json:"host,omitempty"`
+	// APIVersion pins the docker API version. Defaults to DOCKER_API_VERSION,
+	// otherwise the version is negotiated with the daemon.
+	APIVersion string `json:"api_version,omitempty"`
+	// CertPath is the directory containing ca.pem, cert.pem and key.pem used
+	// to connect to a TLS protected daemon. Defaults to DOCKER_CERT_PATH.
+	CertPath string `json:"cert_path,omitempty"`
+	// TLSVerify verifies the daemon certificate against ca.pem in CertPath,
+	// which is implied by TLSCA.
+	TLSVerify bool `json:"tls_verify,omitempty"`
+	// TLSCA, TLSCert and TLSKey are the CA certificate, the client
+	// certificate and its key used to connect to a TLS protected daemon,
+	// either the path of a PEM file or the PEM itself. They take precedence
+	// over the files in CertPath.
+	TLSCA   string `json:"tls_ca,omitempty"`
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+	// Endpoints are the docker daemons to discover upstreams from, their
+	// candidates are merged. Defaults to the single daemon configured above.
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+	// Provider is either `docker` (default), `podman`, `nomad` or
+	// `kubernetes`. With podman the rootless socket in XDG_RUNTIME_DIR is
+	// used if Host and DOCKER_HOST are not set, otherwise the rootful socket.
+	// With nomad Host is the address of the agent, defaults to NOMAD_ADDR,
+	// and the labels are read from the tags of the services. With kubernetes
+	// Host is the address of the API server, defaults to the cluster of the
+	// pod, and the labels are read from the annotations of the services.
+	// With containerd Host is the address of the containerd socket, defaults
+	// to CONTAINERD_ADDRESS, and the labels are read from the pods.
+	Provider string `json:"provider,omitempty"`
+	// ProvidersRaw are third-party providers of upstreams, merged with the
+	// containers. The docker daemon is not connected to if they are set
+	// without Provider, Host and Endpoints.
+	ProvidersRaw []json.RawMessage `json:"providers,omitempty" caddy:"namespace=http.reverse_proxy.upstreams.docker.providers inline_key=provider"`
+	// Mode is either `container` (default), `swarm` or `poll`. In swarm mode
+	// the labels are read from the service specs and the running tasks of
+	// the services are used as upstreams, which requires a manager node. In
+	// poll mode the containers are listed every PollInterval without the
+	// event stream.
+	Mode string `json:"mode,omitempty"`
+	// PollInterval is the interval the containers are listed at in poll
+	// mode, or when the event stream is disabled. Defaults to
+	// ResyncInterval, or 5s.
+	PollInterval caddy.Duration `json:"poll_interval,omitempty"`
+	// DefaultNetwork is the name of the network whose ip address is used
+	// when the upstream.network label is absent. Defaults to any network.
+	DefaultNetwork string `json:"default_network,omitempty"`
+	// HostGateway is the address the containers of the host network are
+	// dialed on, e.g. host.docker.internal when Caddy runs in a container.
+	// Defaults to 127.0.0.1, or the daemon host for tcp and ssh endpoints.
+	HostGateway string `json:"host_gateway,omitempty"`
+	// Webhook is a URL the upstreams are posted to when they change, in the
+	// JSON of the admin API.
+	Webhook string `json:"webhook,omitempty"`
+	// EmitEvents emits the docker.upstream.added and docker.upstream.removed
+	// events through the events app when the upstreams change.
+	EmitEvents bool `json:"emit_events,omitempty"`
+	// Fallback is the address of the upstream of the requests which no
+	// container matches, after the containers with the fallback label.
+	Fallback string `json:"fallback,omitempty"`
+	// HealthCheck excludes containers whose healthcheck reports starting or
+	// unhealthy. The healthcheck label overrides it per container.
+	HealthCheck bool `json:"health_check,omitempty"`
+	// StartupDelay is the longest time a started container is held back
+	// until its healthcheck passes, or its upstream accepts connections if
+	// it has no healthcheck. Zero disables the wait.
+	StartupDelay caddy.Duration `json:"startup_delay,omitempty"`
+	// ProbeInterval is the interval the upstreams are dialed at, the ones
+	// failing ProbeFailures consecutive dials are quarantined until a dial
+	// succeeds. Zero disables the probes.
+	ProbeInterval caddy.Duration `json:"probe_interval,omitempty"`
+	// ProbeFailures is the number of consecutive failed probes quarantining
+	// an upstream. Defaults to 3.
+	ProbeFailures int `json:"probe_failures,omitempty"`
+	// CrashLoopRestarts is the number of exits within 5 minutes quarantining
+	// a container restarting in a loop. Zero disables the quarantine.
+	CrashLoopRestarts int `json:"crash_loop_restarts,omitempty"`
+	// CrashLoopBackoff is the first quarantine of a container restarting in
+	// a loop, doubled for every following loop up to 10m. Defaults to 30s.
+	CrashLoopBackoff caddy.Duration `json:"crash_loop_backoff,omitempty"`
+	// TolerateRestarts keeps a stopped container until it runs again, for
+	// at most the duration, so the retries of the reverse proxy bridge the
+	// quick restarts. Zero disables it.
+	TolerateRestarts caddy.Duration `json:"tolerate_restarts,omitempty"`
+	// ResyncInterval is the interval of the full refreshes done regardless
+	// of the events, in case some were missed. Zero disables them.
+	ResyncInterval caddy.Duration `json:"resync_interval,omitempty"`
+	// ReconnectMaxDelay caps the exponential backoff between the attempts to
+	// reconnect the event stream. Defaults to 30s.
+	ReconnectMaxDelay caddy.Duration `json:"reconnect_max_delay,omitempty"`
+	// APITimeout bounds the requests listing and inspecting the containers
+	// and services, and pinging the daemon. Defaults to 30s.
+	APITimeout caddy.Duration `json:"api_timeout,omitempty"`
+	// APIRateLimit is the number of requests per second listing and
+	// inspecting the containers and services of an endpoint, with bursts of
+	// as many requests. Zero disables the limit.
+	APIRateLimit float64 `json:"api_rate_limit,omitempty"`
+	// DisableAPI are the endpoints of the docker API which are not
+	// requested, for the daemons behind a socket proxy, either `ping` to
+	// check the connection by listing a container, or `events` to poll the
+	// containers every PollInterval. The forbidden endpoints are
+	// detected and fallen back from too.
+	DisableAPI []string `json:"disable_api,omitempty"`
+	// MaxStaleness is the age the upstreams of an endpoint, whose event
+	// stream is down, are reported as stale after, and StalePolicy is
+	// either `serve` (default) to keep providing them, or `fail` to stop.
+	// Zero disables it.
+	MaxStaleness caddy.Duration `json:"max_staleness,omitempty"`
+	StalePolicy  string         `json:"stale_policy,omitempty"`
+	// LazyConnect doesn't fail the provisioning when an endpoint is
+	// unreachable, it starts without its upstreams and keeps connecting to
+	// it in the background.
+	LazyConnect bool `json:"lazy_connect,omitempty"`
+	// Debounce is the window coalescing bursts of events into a single
+	// refresh. Defaults to 100ms.
+	Debounce caddy.Duration `json:"debounce,omitempty"`
+	// AutoDetectPort uses the exposed port of the containers, or the target
+	// port of the services, without the upstream.port label if there is
+	// exactly one, or the first of PortPreference among several.
+	AutoDetectPort bool `json:"auto_detect_port,omitempty"`
+	// CaddyNetworks only dials the containers on the networks of the
+	// container Caddy runs in, found by inspecting it, unless the network
+	// label or DefaultNetwork names the network. Container mode only.
+	CaddyNetworks bool `json:"caddy_networks,omitempty"`
+	// PortPreference are the port numbers or names detected among several
+	// ports, in order. Defaults to http, 80, 8080, 3000 and 8000.
+	PortPreference []string `json:"port_preference,omitempty"`
+	// UsePublishedPorts dials the host port the upstream port is published
+	// on, for Caddy running outside of the container networks. The
+	// upstream.published label overrides it per container.
+	UsePublishedPorts bool `json:"use_published_ports,omitempty"`
+	// IPVersion is the ip version of the addresses dialed, either
+	// `prefer_ipv4` (default), `prefer_ipv6`, `ipv4_only` or `ipv6_only`.
+	IPVersion string `json:"ip_version,omitempty"`
+	// DialName dials the upstreams by name instead of ip address, resolved
+	// by the embedded DNS server of the user-defined networks. Either
+	// `container` for the container name, or `service` for the compose
+	// service name. Only in container mode without published ports.
+	DialName string `json:"dial_name,omitempty"`
+	// SwarmDial is how the upstreams of the swarm services are dialed,
+	// either `tasks` (default) for the ip addresses of the tasks, or `vip`
+	// for the virtual ip of the services, the services in dnsrr endpoint
+	// mode always dialing their tasks. The upstream.swarm_dial label
+	// overrides it per service.
+	SwarmDial string `json:"swarm_dial,omitempty"`
+	// AddressTemplate renders the dial address of the containers from the
+	// placeholders {ip}, {port}, {container_name}, {container_id},
+	// {network}, {service}, {host_ip} and {host_port}, e.g.
+	// `{container_name}.{network}:{port}`. It takes precedence over
+	// DialName and UsePublishedPorts. Only in container mode.
+	AddressTemplate string `json:"address_template,omitempty"`
+	// GroupComposeServices makes the replicas of a compose service share
+	// the matchers and selection policy of one of them, and warns when
+	// their matcher labels disagree.
+	GroupComposeServices bool `json:"group_compose_services,omitempty"`
+	// RecreateTimeout keeps the last container of a compose service until
+	// a container replaces it, for at most the timeout, so recreating it
+	// doesn't leave the service without upstream. Zero disables it.
+	RecreateTimeout caddy.Duration `json:"recreate_timeout,omitempty"`
+	// WaitDependencies withholds the containers of a compose service until
+	// the services of its depends_on reach their condition, e.g.
+	// service_healthy. Only in container mode.
+	WaitDependencies bool `json:"wait_dependencies,omitempty"`
+	// FilterComposeProject only discovers the containers of the listed
+	// compose projects, or the services of the listed stacks in swarm mode.
+	FilterComposeProject []string `json:"filter_compose_project,omitempty"`
+	// FilterLabel only discovers the containers, or the services in swarm
+	// mode, having all the labels, either `<key>` or `<key>=<value>`.
+	FilterLabel []string `json:"filter_label,omitempty"`
+	// IncludeName and IncludeImage only discover the containers whose name,
+	// or image, matches one of the glob patterns, ExcludeName and
+	// ExcludeImage leave out the ones matching any, e.g. `*-migrate` for
+	// one-off jobs inheriting the labels of a service. Only in container
+	// mode.
+	IncludeName  []string `json:"include_name,omitempty"`
+	IncludeImage []string `json:"include_image,omitempty"`
+	ExcludeName  []string `json:"exclude_name,omitempty"`
+	ExcludeImage []string `json:"exclude_image,omitempty"`
+	// LabelPrefix replaces the `com.caddyserver.http` prefix of all labels,
+	// e.g. `caddy` for `caddy.enable` and `caddy.matchers.host`. The labels
+	// with the default prefix are ignored when it is set.
+	LabelPrefix string `json:"label_prefix,omitempty"`
+	// Instance names the candidate set of the module, so several modules
+	// discover different containers, e.g. for a public and an internal
+	// reverse proxy. The label prefix defaults to `com.caddyserver.http.`
+	// followed by the name.
+	Instance string `json:"instance,omitempty"`
+	// EnvLabels reads the labels absent from the CADDY_* environment
+	// variables of the containers, e.g. CADDY_UPSTREAM_PORT for the
+	// upstream.port label. The containers are inspected once to read them.
+	EnvLabels bool `json:"env_labels,omitempty"`
+	// Traefik translates the traefik labels of the containers, that is
+	// traefik.enable, the rules of the routers and the port and scheme of
+	// the load balancer servers. The module labels take precedence.
+	Traefik bool `json:"traefik,omitempty"`
+	// StrictLabels fails loading the config when a container listed at
+	// that time has invalid labels. By default they are logged, and the
+	// container is skipped.
+	StrictLabels bool `json:"strict_labels,omitempty"`
+
+	ctx      caddy.Context
+	logger   *zap.Logger
+	fallback *reverseproxy.Upstream
+	webhook  *webhook
+	events   *caddyevents.App
+	instance *instance
+	// selfID is the id of the container Caddy runs in, see isSelf.
+	selfID     string
+	selfWarned bool
+	// acquired is whether the module references its instance, see
+	// instance.acquire.
+	acquired bool
+	startups map[string]*startup
+	// noIPs holds when the running containers were first seen without ip
+	// address.
+	noIPs map[string]time.Time
+	// invalid holds the containers skipped for their invalid labels, which
+	// are only logged once.
+	invalid map[string]struct{}
+	// replaced holds when the compose services kept by keepReplaced were
+	// left without candidate.
+	replaced map[composeKey]time.Time
+	// globs are the include and exclude patterns, compiled once.
+	globs     excludeGlobs
+	endpoints []*endpoint
 }
 
 func (Upstreams) CaddyModule() caddy.ModuleInfo {
@@ -52,186 +428,1296 @@ func (Upstreams) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-func (u *Upstreams) provisionCandidates(ctx caddy.Context, containers []types.Container) {
-	updated := make([]candidate, 0, len(containers))
+// provisionCandidate builds the matchers and the metadata of a candidate from
+// the labels, fields identify the container in logs.
+func (u *Upstreams) provisionCandidate(ctx caddy.Context, labels map[string]string, used map[string]*lbPolicy, fields ...zap.Field) candidate {
+	c := candidate{
+		labels:      labels,
+		matchers:    u.provisionMatchers(ctx, labels, fields...),
+		deployGroup: labels[LabelUpstreamGroup],
+		scheme:      labels[LabelUpstreamScheme],
+		insecure:    labels[LabelUpstreamTLSInsecureSkipVerify] == "true",
+		protocol:    labels[LabelUpstreamProtocol],
+		weight:      u.positiveLabel(labels, LabelUpstreamWeight, 1, fields...),
+		maxRequests: u.positiveLabel(labels, LabelUpstreamMaxRequests, 0, fields...),
+		priority:    u.priorityLabel(labels, fields...),
+		fallback:    labels[LabelFallback] == "true",
+		mirror:      labels[LabelMirror] == "true",
+		tls:         tlsLabels(labels),
+		headers:     headerLabels(labels),
+		host:        labels[LabelUpstreamHost],
+	}
+
+	var err error
+	c.group, c.policy, err = provisionPolicy(labels, u.instance.policies, used)
+	if err != nil {
+		u.logger.Error("unable to load selection policy", append(fields,
+			zap.String("value", labels[LabelLBPolicy]),
+			zap.Error(err),
+		)...)
+	}
+
+	return c
+}
+
+// positiveLabel parses the positive integer of the label, or returns def if
+// the label is absent or invalid.
+func (u *Upstreams) positiveLabel(labels map[string]string, key string, def int, fields ...zap.Field) int {
+	value, ok := labels[key]
+	if !ok {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		u.logger.Error("invalid positive integer label", append(fields,
+			zap.String("key", key),
+			zap.String("value", value),
+		)...)
+		return def
+	}
+
+	return n
+}
+
+// provisionMatchers returns the matcher sets of the labels, either a single
+// set, or a set per matcher group with the matchers without group.
+func (u *Upstreams) provisionMatchers(ctx caddy.Context, labels map[string]string, fields ...zap.Field) caddyhttp.MatcherSets {
+	var matchers caddyhttp.MatcherSet
+	groups := make(map[int]caddyhttp.MatcherSet)
+
+	for key, value := range labels {
+		matcher, ok, err := produceMatcher(key, value)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			u.logger.Error("unable to load matcher", append(fields,
+				zap.String("key", key),
+				zap.String("value", value),
+				zap.Error(err),
+			)...)
+			continue
+		}
+
+		if prov, ok := matcher.(caddy.Provisioner); ok {
+			err = prov.Provision(ctx)
+			if err != nil {
+				u.logger.Error("unable to provision matcher", append(fields,
+					zap.String("key", key),
+					zap.String("value", value),
+					zap.Error(err),
+				)...)
+				continue
+			}
+		}
+
+		if group, _, ok := matcherGroup(key); ok {
+			groups[group] = append(groups[group], matcher)
+			continue
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	if len(groups) == 0 {
+		if len(matchers) == 0 {
+			return nil
+		}
+		return caddyhttp.MatcherSets{matchers}
+	}
+
+	indexes := make([]int, 0, len(groups))
+	for group := range groups {
+		indexes = append(indexes, group)
+	}
+	sort.Ints(indexes)
+
+	sets := make(caddyhttp.MatcherSets, 0, len(groups))
+	for _, group := range indexes {
+		set := append(append(caddyhttp.MatcherSet(nil), matchers...), groups[group]...)
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// provisionCandidates rebuilds the candidates from the objects last listed
+// from every endpoint.
+func (u *Upstreams) provisionCandidates(ctx caddy.Context) {
+	previous := u.instance.loadSnapshot()
+	var updated []candidate
+	used := make(map[string]*lbPolicy)
+
+	for _, e := range u.endpoints {
+		e.summary = refreshSummary{}
+		built := len(updated)
+
+		switch {
+		case e.provider != nil:
+			updated = u.appendProviderCandidates(ctx, updated, e, used)
+		case u.Mode == ModeSwarm:
+			updated = u.appendSwarmCandidates(ctx, updated, e, used)
+		default:
+			e.forgetStopping()
+			updated = u.appendContainerCandidates(ctx, updated, e, used)
+		}
+
+		listed := len(e.containers)
+		switch {
+		case e.provider != nil:
+			listed = len(e.targets)
+		case u.Mode == ModeSwarm:
+			listed = len(e.tasks)
+		}
+		metrics.containers.WithLabelValues(e.name).Set(float64(listed))
+
+		e.summary.listed = listed
+		e.summary.candidates = len(updated) - built
+		for i := built; i < len(updated); i++ {
+			updated[i].confirmed = e.confirmed
+		}
+		if e.summary.enabled == 0 {
+			// Only the containers are counted while building candidates.
+			e.summary.enabled = len(u.labeledObjects(e))
+		}
+	}
+
+	if u.GroupComposeServices && u.Mode != ModeSwarm {
+		u.shareComposeMatchers(updated)
+	}
+	if u.RecreateTimeout > 0 && u.Mode != ModeSwarm {
+		updated = u.keepReplaced(previous.candidates, updated)
+	}
+	if u.TolerateRestarts > 0 && u.Mode != ModeSwarm {
+		updated = u.keepRestarted(previous.candidates, updated)
+	}
+
+	sortCandidates(updated)
+
+	u.forgetStartups()
+	for i := range updated {
+		updated[i].instance = u.Instance
+	}
+	u.instance.policies = used
+	reuseUpstreams(previous, updated)
+
+	byDial := make(map[string]candidate, len(updated))
+	for _, c := range updated {
+		byDial[c.address] = c
+	}
+	notify := u.webhook != nil && changed(previous.candidates, updated)
+
+	s := &snapshot{
+		candidates: updated,
+		byDial:     byDial,
+		hosts:      indexHosts(updated),
+		groups:     deploymentGroups(updated),
+		refreshed:  time.Now(),
+	}
+	u.instance.current.Store(s)
+	if hasHealthChecks(s) {
+		u.instance.startHealthChecks()
+	}
+
+	if notify {
+		err := u.webhook.queue(s.refreshed, updated)
+		if err != nil {
+			u.logger.Error("unable to encode upstreams for webhook", zap.Error(err))
+		}
+	}
+
+	if u.events != nil {
+		u.emitEvents(u.events, previous.candidates, updated)
+	}
+
+	metrics.candidates.WithLabelValues(u.Instance).Set(float64(len(updated)))
+	metrics.lastRefresh.SetToCurrentTime()
+}
+
+// sortCandidates orders the candidates by name, so the selection policies
+// depending on the order of the upstreams, e.g. round_robin and first, don't
+// change with the order the objects are listed in.
+func sortCandidates(updated []candidate) {
+	sort.SliceStable(updated, func(i, j int) bool {
+		a, b := updated[i], updated[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.endpoint != b.endpoint {
+			return a.endpoint < b.endpoint
+		}
+		return a.address < b.address
+	})
+}
+
+// reuseUpstreams replaces the upstreams of the candidates by the ones of the
+// previous snapshot with the same dial address and max_requests label, so the
+// requests keep getting the same upstream objects. The host of an upstream,
+// which holds its request count and passive health, is not kept: the proxy
+// deletes the hosts of the dynamic upstreams after every request.
+func reuseUpstreams(previous *snapshot, updated []candidate) {
+	for i, c := range updated {
+		p, ok := previous.byDial[c.address]
+		// The proxy sets MaxRequests of the upstreams without one to the
+		// unhealthy_request_count of the passive health checks, so the
+		// labels are compared.
+		if ok && p.upstream.Dial == c.upstream.Dial && p.maxRequests == c.maxRequests {
+			updated[i].upstream = p.upstream
+		}
+	}
+}
 
-	for _, container := range containers {
+// lookupCandidate returns the candidate of the upstream dial address, in
+// any instance.
+func lookupCandidate(address string) (candidate, bool) {
+	for _, s := range loadSnapshots() {
+		if c, ok := s.byDial[address]; ok {
+			return c, true
+		}
+	}
+	return candidate{}, false
+}
+
+func (u *Upstreams) appendContainerCandidates(ctx caddy.Context, updated []candidate, e *endpoint, used map[string]*lbPolicy) []candidate {
+	for _, container := range e.containers {
 		// Check enable.
 		if enable, ok := container.Labels[LabelEnable]; !ok || enable != "true" {
 			continue
 		}
+		e.summary.enabled++
 
-		fmt.Println(container.Labels)
-		// If there is the healtcheck label, honor it, otherwise continue
-		if healthcheck, ok := container.Labels[LabelHealthCheck]; ok && healthcheck == "true" {
-			u.logger.Info("checking container health")
-			if container.State != types.Healthy {
-				u.logger.Info("container is not healthy",
+		// Check self, Caddy would proxy to itself in a loop.
+		if u.isSelf(container.ID) {
+			if !u.selfWarned {
+				u.logger.Warn("skip container of caddy which has the enable label",
 					zap.String("container_id", container.ID),
-					zap.String("container_name", container.Names[0]),
-					zap.String("container_state", container.State),
 				)
-				continue
+				u.selfWarned = true
 			}
+			e.summary.skip("self")
+			continue
 		}
 
-		// Build matchers.
-		var matchers caddyhttp.MatcherSet
+		// Check labels.
+		if errs := u.checkLabels(container.Labels, nil); len(errs) > 0 {
+			if _, ok := u.invalid[container.ID]; !ok {
+				u.logger.Warn("skip container having invalid labels",
+					zap.String("container_id", container.ID),
+					zap.String("container_name", containerName(container)),
+					zap.Error(errors.Join(errs...)),
+				)
+				u.invalid[container.ID] = struct{}{}
+			}
+			e.summary.skip("invalid_labels")
+			continue
+		}
 
-		for key, producer := range producers {
-			value, ok := container.Labels[key]
-			if !ok {
+		// Check compose project.
+		if !u.inProject(container.Labels[composeProjectLabel]) {
+			e.summary.skip("compose_project")
+			continue
+		}
+
+		// Check name and image.
+		if u.excluded(container) {
+			u.logger.Debug("skip container which is excluded",
+				zap.String("container_id", container.ID),
+				zap.String("image", container.Image),
+			)
+			e.summary.skip("excluded")
+			continue
+		}
+
+		// Check paused, the list reports paused containers as running.
+		if container.State == "paused" {
+			u.logger.Debug("skip container which is paused",
+				zap.String("container_id", container.ID),
+			)
+			e.summary.skip("paused")
+			continue
+		}
+
+		// Check stopping.
+		if e.isStopping(container.ID) {
+			u.logger.Debug("skip container which is being stopped",
+				zap.String("container_id", container.ID),
+			)
+			e.summary.skip("stopping")
+			continue
+		}
+
+		// Check restarting, the containers waiting to be restarted by their
+		// restart policy are listed as well.
+		if container.State == "restarting" || e.isCrashLooping(container.ID) {
+			u.logger.Debug("skip container which is restarting",
+				zap.String("container_id", container.ID),
+			)
+			e.summary.skip("restarting")
+			continue
+		}
+
+		// Check health.
+		if u.healthCheck(container.Labels) {
+			health := containerHealth(container)
+			if health == types.Starting || health == types.Unhealthy {
+				u.logger.Debug("skip container which is not healthy",
+					zap.String("container_id", container.ID),
+					zap.String("health", health),
+				)
+				e.summary.skip("unhealthy")
 				continue
 			}
+		}
 
-			matcher, err := producer(value)
-			if err != nil {
-				u.logger.Error("unable to load matcher",
-					zap.String("key", key),
-					zap.String("value", value),
-					zap.Error(err),
+		// Check dependencies.
+		if u.WaitDependencies {
+			if service, ok := e.unmetDependency(container); ok {
+				u.logger.Debug("skip container whose dependency is not ready",
+					zap.String("container_id", container.ID),
+					zap.String("dependency", service),
 				)
+				e.summary.skip("dependencies")
 				continue
 			}
+		}
 
-			if prov, ok := matcher.(caddy.Provisioner); ok {
-				err = prov.Provision(ctx)
-				if err != nil {
-					u.logger.Error("unable to provision matcher",
-						zap.String("key", key),
-						zap.String("value", value),
-						zap.Error(err),
-					)
+		// Build matchers and metadata.
+		networkName, ip, hasNetwork := u.containerNetwork(e, container, u.network(container.Labels))
+		labels := expandLabels(container.Labels, containerPlaceholders(container, networkName))
+
+		for _, named := range namedUpstreams(labels) {
+			c := u.provisionCandidate(ctx, named.labels, used, zap.String("container_id", container.ID), zap.String("upstream", named.name))
+
+			// Build upstream.
+			dialNetwork, address := "tcp", ""
+			if socket, ok := named.labels[LabelUpstreamSocket]; ok {
+				dialNetwork, address = "unix", socket
+			} else {
+				labeled := container
+				labeled.Labels = named.labels
+				if address, ok = u.containerAddress(e, labeled, networkName, ip, hasNetwork); !ok {
+					e.summary.skip("no_address")
 					continue
 				}
 			}
 
-			matchers = append(matchers, matcher)
+			// Wait for the container to be ready.
+			if u.StartupDelay > 0 && !u.ready(e, container, dialNetwork, address) {
+				e.summary.skip("starting")
+				continue
+			}
+
+			c.endpoint = e.name
+			c.id = container.ID
+			c.name = containerName(container)
+			c.upstreamName = named.name
+			if named.name != "" {
+				c.name += "." + named.name
+			}
+			c.health = containerHealth(container)
+			c.address = address
+			c.upstream = &reverseproxy.Upstream{Dial: address, MaxRequests: c.maxRequests}
+			if dialNetwork == "unix" {
+				c.upstream.Dial = "unix/" + address
+			}
+
+			updated = append(updated, c)
 		}
+	}
 
-		// Build upstream.
-		port, ok := container.Labels[LabelUpstreamPort]
-		if !ok {
-			u.logger.Error("unable to get port from container labels",
+	return updated
+}
+
+// containerAddress returns the tcp address of the container upstream, which
+// is either the address template rendered, or its published port, or its
+// name or ip address in the network, or the port on the host for the host
+// network.
+func (u *Upstreams) containerAddress(e *endpoint, container types.Container, networkName, ip string, hasNetwork bool) (string, bool) {
+	port, ok := u.containerPort(container)
+	if !ok {
+		u.logger.Error("unable to get port from container labels",
+			zap.String("container_id", container.ID),
+			zap.Bool("auto_detect_port", u.AutoDetectPort),
+		)
+		return "", false
+	}
+
+	if u.AddressTemplate != "" {
+		address, err := renderAddress(u.AddressTemplate, addressPlaceholders(e, container, networkName, ip, port))
+		if err != nil {
+			u.logger.Error("unable to render address template",
 				zap.String("container_id", container.ID),
+				zap.String("address_template", u.AddressTemplate),
+				zap.Error(err),
 			)
-			continue
+			return "", false
+		}
+		return address, true
+	}
+
+	if isHostNetwork(container) {
+		host := u.HostGateway
+		if host == "" {
+			host = e.publishedHost()
 		}
+		return net.JoinHostPort(host, port), true
+	}
 
-		if len(container.NetworkSettings.Networks) == 0 {
-			u.logger.Error("unable to get ip address from container networks",
+	if u.usePublishedPorts(container.Labels) {
+		address, ok := publishedAddress(e, container, port)
+		if !ok {
+			u.logger.Error("unable to get published port of container",
 				zap.String("container_id", container.ID),
+				zap.String("port", port),
 			)
+		}
+		return address, ok
+	}
+
+	if !hasNetwork {
+		if u.waitIP(e, container) {
+			return "", false
+		}
+		u.logger.Error("unable to get ip address from container networks",
+			zap.String("container_id", container.ID),
+			zap.String("network", u.network(container.Labels)),
+		)
+		return "", false
+	}
+	delete(u.noIPs, container.ID)
+
+	switch u.DialName {
+	case DialNameContainer:
+		return net.JoinHostPort(containerName(container), port), true
+	case DialNameService:
+		if service, ok := container.Labels[composeServiceLabel]; ok {
+			return net.JoinHostPort(service, port), true
+		}
+	}
+
+	return net.JoinHostPort(ip, port), true
+}
+
+func containerName(container types.Container) string {
+	if len(container.Names) == 0 {
+		return container.ID
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+// healthCheck reports whether the health status of the container is honored.
+func (u *Upstreams) healthCheck(labels map[string]string) bool {
+	if value, ok := labels[LabelHealthCheck]; ok {
+		return value == "true"
+	}
+	return u.HealthCheck
+}
+
+// containerHealth returns the health status of the container, which the list
+// API only reports as part of the human-readable status.
+func containerHealth(container types.Container) string {
+	switch {
+	case strings.HasSuffix(container.Status, "(healthy)"):
+		return types.Healthy
+	case strings.HasSuffix(container.Status, "(unhealthy)"):
+		return types.Unhealthy
+	case strings.HasSuffix(container.Status, "(health: starting)"):
+		return types.Starting
+	default:
+		return types.NoHealthcheck
+	}
+}
+
+// containerPort returns the upstream port of the container, or its exposed
+// tcp port if the label is absent and auto detection is enabled.
+func (u *Upstreams) containerPort(container types.Container) (string, bool) {
+	if port, ok := container.Labels[LabelUpstreamPort]; ok {
+		return port, true
+	}
+
+	if !u.AutoDetectPort {
+		return "", false
+	}
+
+	// Ports are listed once per host ip they are published on.
+	exposed := make(map[int]string, len(container.Ports))
+	for _, port := range container.Ports {
+		if port.Type == "tcp" {
+			exposed[int(port.PrivatePort)] = ""
+		}
+	}
+
+	return u.detectPort(exposed, zap.String("container_id", container.ID))
+}
+
+// usePublishedPorts reports whether the upstream is dialed with the port
+// published on the host instead of the container ip address.
+func (u *Upstreams) usePublishedPorts(labels map[string]string) bool {
+	if value, ok := labels[LabelUpstreamPublished]; ok {
+		return value == "true"
+	}
+	return u.UsePublishedPorts
+}
+
+// publishedAddress returns the host address the container port is published
+// on, ports published on all interfaces are dialed with the endpoint host.
+func publishedAddress(e *endpoint, container types.Container, port string) (string, bool) {
+	host, hostPort, ok := publishedBinding(e, container, port)
+	if !ok {
+		return "", false
+	}
+	return net.JoinHostPort(host, hostPort), true
+}
+
+// publishedBinding returns the host and the host port which the container
+// port is published on.
+func publishedBinding(e *endpoint, container types.Container, port string) (string, string, bool) {
+	var host, hostPort string
+
+	for _, p := range container.Ports {
+		if p.Type != "tcp" || p.PublicPort == 0 || strconv.Itoa(int(p.PrivatePort)) != port {
 			continue
 		}
 
-		// Use the first network settings of container.
-		for _, settings := range container.NetworkSettings.Networks {
-			address := net.JoinHostPort(settings.IPAddress, port)
-			upstream := &reverseproxy.Upstream{Dial: address}
+		host = p.IP
+		if ip := net.ParseIP(host); host == "" || ip.IsUnspecified() {
+			host = e.publishedHost()
+		}
+		hostPort = strconv.Itoa(int(p.PublicPort))
 
-			updated = append(updated, candidate{
-				matchers: matchers,
-				upstream: upstream,
-			})
+		// Prefer the IPv4 binding.
+		if !strings.Contains(p.IP, ":") {
 			break
 		}
 	}
 
-	candidatesMu.Lock()
-	candidates = updated
-	candidatesMu.Unlock()
+	return host, hostPort, hostPort != ""
+}
+
+// network returns the name of the network used to reach the upstream, an
+// empty name means any network.
+func (u *Upstreams) network(labels map[string]string) string {
+	if name, ok := labels[LabelUpstreamNetwork]; ok {
+		return name
+	}
+	return u.DefaultNetwork
+}
+
+// containerNetwork returns the named network of the container and its ip
+// address, or the first network with an ip address if name is empty, which
+// Caddy is attached to with CaddyNetworks.
+func (u *Upstreams) containerNetwork(e *endpoint, container types.Container, name string) (string, string, bool) {
+	if container.NetworkSettings == nil {
+		return "", "", false
+	}
+
+	if name != "" {
+		settings, ok := container.NetworkSettings.Networks[name]
+		if !ok {
+			return name, "", false
+		}
+		ip := u.pickIP(settings.IPAddress, settings.GlobalIPv6Address)
+		return name, ip, ip != ""
+	}
+
+	// Use the first network settings of container.
+	for name, settings := range container.NetworkSettings.Networks {
+		if !e.onCaddyNetwork(name, settings.NetworkID) {
+			continue
+		}
+		if ip := u.pickIP(settings.IPAddress, settings.GlobalIPv6Address); ip != "" {
+			return name, ip, true
+		}
+	}
+
+	return "", "", false
+}
+
+// pickIP returns the address of the preferred ip version, which may be
+// empty.
+func (u *Upstreams) pickIP(ipv4, ipv6 string) string {
+	switch u.IPVersion {
+	case IPVersionIPv4Only:
+		return ipv4
+	case IPVersionIPv6Only:
+		return ipv6
+	case IPVersionPreferIPv6:
+		if ipv6 != "" {
+			return ipv6
+		}
+		return ipv4
+	default:
+		if ipv4 != "" {
+			return ipv4
+		}
+		return ipv6
+	}
+}
+
+// labelFilters returns the filters of the objects to list, which have the
+// enable label and all the filter labels.
+func (u *Upstreams) labelFilters() filters.Args {
+	args := filters.NewArgs()
+	// The traefik.enable label and the environment variables are read after
+	// listing.
+	if !u.Traefik && !u.EnvLabels {
+		args.Add("label", u.prefixedLabel(LabelEnable))
+	}
+	for _, label := range u.FilterLabel {
+		args.Add("label", label)
+	}
+	return args
+}
+
+// prefixedLabel returns the label with the configured prefix.
+func (u *Upstreams) prefixedLabel(label string) string {
+	if u.LabelPrefix == "" {
+		return label
+	}
+	return u.LabelPrefix + strings.TrimPrefix(label, defaultLabelPrefix)
+}
+
+// readLabels returns the labels of a listed container or service as they are
+// looked up by the module, fields identify it in logs.
+func (u *Upstreams) readLabels(labels map[string]string, fields ...zap.Field) map[string]string {
+	labels = u.canonicalLabels(labels)
+	if u.Traefik {
+		translated, err := translateTraefik(labels)
+		if err != nil {
+			u.logger.Error("unable to translate traefik labels", append(fields, zap.Error(err))...)
+		}
+		labels = translated
+	}
+	return u.canaryLabels(labels, fields...)
+}
+
+// canonicalLabels returns the labels with the configured prefix replaced by
+// the default one, so they can be looked up with the label constants.
+func (u *Upstreams) canonicalLabels(labels map[string]string) map[string]string {
+	if u.LabelPrefix == "" {
+		return labels
+	}
+
+	canonical := make(map[string]string, len(labels))
+	for key, value := range labels {
+		switch {
+		case strings.HasPrefix(key, u.LabelPrefix+"."):
+			canonical[defaultLabelPrefix+strings.TrimPrefix(key, u.LabelPrefix)] = value
+		case strings.HasPrefix(key, defaultLabelPrefix+"."):
+			// Ignored in favor of the configured prefix.
+		default:
+			canonical[key] = value
+		}
+	}
+	return canonical
+}
+
+// inProject reports whether the compose project, or the stack, is discovered.
+func (u *Upstreams) inProject(project string) bool {
+	if len(u.FilterComposeProject) == 0 {
+		return true
+	}
+	for _, p := range u.FilterComposeProject {
+		if p == project {
+			return true
+		}
+	}
+	return false
+}
+
+// relevantEvent reports whether the event may change the candidates. Podman
+// doesn't always honor the type filter, and both engines emit exec events
+// for every healthcheck run.
+func relevantEvent(message events.Message) bool {
+	switch message.Type {
+	case events.ContainerEventType, events.ServiceEventType:
+	default:
+		return false
+	}
+	return !strings.HasPrefix(message.Action, "exec_")
+}
+
+// terminationSignals are the signals of the kill events which stop the
+// container, unlike the ones reloading it like SIGHUP.
+var terminationSignals = map[string]struct{}{
+	"2": {}, "3": {}, "9": {}, "15": {},
+	"SIGINT": {}, "SIGQUIT": {}, "SIGKILL": {}, "SIGTERM": {},
+}
+
+// stopEvent reports whether the container event stops the container. The
+// kill event is sent as soon as the stop signal is, while the container may
+// still be running until it exits.
+func stopEvent(message events.Message) bool {
+	switch message.Action {
+	case "die", "stop":
+		return true
+	case "kill":
+		_, ok := terminationSignals[message.Actor.Attributes["signal"]]
+		return ok
+	default:
+		return false
+	}
+}
+
+// refresh lists the objects of the endpoint and rebuilds the candidates.
+func (u *Upstreams) refresh(ctx caddy.Context, e *endpoint) error {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	switch {
+	case e.provider != nil:
+		err := u.listProvider(ctx, e)
+		if err != nil {
+			return err
+		}
+	case u.Mode == ModeSwarm:
+		err := e.listSwarm(ctx, u.labelFilters())
+		if err != nil {
+			return err
+		}
+		for i := range e.services {
+			if spec := e.services[i].Spec.TaskTemplate.ContainerSpec; u.EnvLabels && spec != nil {
+				e.services[i].Spec.Labels = withEnvLabels(e.services[i].Spec.Labels, spec.Env, u.LabelPrefix)
+			}
+			e.services[i].Spec.Labels = u.readLabels(e.services[i].Spec.Labels, zap.String("service_id", e.services[i].ID))
+		}
+	default:
+		options := types.ContainerListOptions{Filters: u.labelFilters()}
+		if u.WaitDependencies {
+			// The containers of the dependencies are listed along, even
+			// stopped or without the enable label.
+			options = types.ContainerListOptions{All: true}
+		}
+
+		listCtx, cancel := e.apiContext(ctx)
+		err := e.throttle(listCtx)
+		var containers []types.Container
+		if err == nil {
+			containers, err = e.cli.ContainerList(listCtx, options)
+		}
+		cancel()
+		if err != nil {
+			return fmt.Errorf("unable to get the list of containers: %w", err)
+		}
+		all := containers
+		if u.WaitDependencies {
+			containers = listedContainers(all, u.labelFilters())
+		}
+		u.readContainers(ctx, e, containers)
+		if u.CaddyNetworks {
+			u.inspectCaddyNetworks(ctx, e)
+		}
+		e.containers = containers
+		e.forgetEnvs()
+		if u.WaitDependencies {
+			e.readDependencies(all)
+		}
+	}
+
+	e.confirmed = time.Now()
+	u.provisionCandidates(ctx)
+	u.logSummary(e)
+	return nil
 }
 
-func (u *Upstreams) keepUpdated(ctx caddy.Context, cli *client.Client) {
-	debounced := debounce.New(100 * time.Millisecond)
+// update lists the given containers of the endpoint again and rebuilds the
+// candidates, the containers which are not running anymore are removed.
+func (u *Upstreams) update(ctx caddy.Context, e *endpoint, ids []string) error {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
 
+	args := u.labelFilters()
+	for _, id := range ids {
+		args.Add("id", id)
+	}
+
+	listCtx, cancel := e.apiContext(ctx)
+	err := e.throttle(listCtx)
+	var containers []types.Container
+	if err == nil {
+		containers, err = e.cli.ContainerList(listCtx, types.ContainerListOptions{Filters: args})
+	}
+	cancel()
+	if err != nil {
+		return fmt.Errorf("unable to get the list of containers: %w", err)
+	}
+
+	updated := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		updated[id] = struct{}{}
+	}
+
+	kept := make([]types.Container, 0, len(e.containers)+len(containers))
+	for _, container := range e.containers {
+		if _, ok := updated[container.ID]; !ok {
+			kept = append(kept, container)
+		}
+	}
+	u.readContainers(ctx, e, containers)
+	e.containers = append(kept, containers...)
+	e.forgetEnvs()
+	if u.WaitDependencies && e.untrackedDependency(containers) {
+		// The states of the dependencies are only read by refresh.
+		e.scheduleUpdate(0, "")
+	}
+
+	e.confirmed = time.Now()
+	u.provisionCandidates(ctx)
+	return nil
+}
+
+// eventFilters returns the filters of the event stream. The actions are not
+// filtered, so the update events of the containers and swarm services refresh
+// them like the others, relevantEvent dropping the exec ones.
+func (u *Upstreams) eventFilters() filters.Args {
+	args := filters.NewArgs(filters.Arg("type", events.ContainerEventType))
+	if u.Mode == ModeSwarm {
+		args.Add("type", events.ServiceEventType)
+	}
+	return args
+}
+
+func (u *Upstreams) keepUpdated(ctx caddy.Context, e *endpoint) {
+	if e.noEvents {
+		u.pollDocker(ctx, e)
+		return
+	}
+
+	debounced := debounce.New(time.Duration(u.Debounce))
+
+	refresh := func() {
+		ids, full := e.takeUpdates()
+
+		var err error
+		switch {
+		case full || u.Mode == ModeSwarm:
+			err = u.refresh(ctx, e)
+		case len(ids) > 0:
+			err = u.update(ctx, e, ids)
+		}
+		if err != nil {
+			metrics.apiErrors.WithLabelValues(e.name).Inc()
+			u.logger.Error("unable to refresh candidates",
+				zap.String("endpoint", e.name),
+				zap.Error(err),
+			)
+			// Retry with a full refresh, the daemon may be restarting.
+			e.scheduleUpdate(refreshRetryInterval, "")
+		}
+	}
+
+	var resync <-chan time.Time
+	if u.ResyncInterval > 0 {
+		ticker := time.NewTicker(time.Duration(u.ResyncInterval))
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	metrics.streamUp.WithLabelValues(e.name).Set(1)
+
+	reconnected := false
 	for {
-		messages, errs := cli.Events(ctx, types.EventsOptions{
-			Filters: filters.NewArgs(filters.Arg("type", events.ContainerEventType)),
-		})
+		messages, errs := e.cli.Events(ctx, types.EventsOptions{Filters: u.eventFilters()})
+
+		// Events may be missed while reconnecting, and the containers may
+		// have changed if the daemon restarted, so list them again once
+		// subscribed.
+		if reconnected {
+			metrics.reconnects.WithLabelValues(e.name).Inc()
+			e.update("")
+			refresh()
+		}
 
 	selectLoop:
 		for {
 			select {
-			case <-messages:
-				debounced(func() {
-					containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
-						Filters: filters.NewArgs(filters.Arg("label", LabelEnable)),
-					})
-					if err != nil {
-						u.logger.Error("unable to get the list of containers", zap.Error(err))
-						return
-					}
+			case message := <-messages:
+				if !relevantEvent(message) {
+					continue
+				}
+				if message.Type != events.ContainerEventType {
+					e.update("")
+					debounced(refresh)
+					continue
+				}
 
-					u.provisionCandidates(ctx, containers)
-				})
+				e.update(message.Actor.ID)
+				if u.WaitDependencies && e.isDependency(message.Actor.Attributes) {
+					// The dependencies are not listed by update.
+					e.update("")
+				}
+				switch {
+				case stopEvent(message):
+					// Remove the container right away instead of routing
+					// requests to it until the debounced refresh.
+					e.setStopping(message.Actor.ID, true)
+					if message.Action == "die" && u.CrashLoopRestarts > 0 {
+						u.crashed(e, message.Actor.ID)
+					}
+					if u.TolerateRestarts > 0 {
+						// Drop the container once the tolerance is over.
+						e.setRestarting(message.Actor.ID)
+						e.scheduleUpdate(time.Duration(u.TolerateRestarts), message.Actor.ID)
+					}
+					refresh()
+					continue
+				case message.Action == "pause":
+					refresh()
+					continue
+				case message.Action == "start":
+					e.setStopping(message.Actor.ID, false)
+				}
+				debounced(refresh)
+			case <-e.wakeup:
+				debounced(refresh)
+			case <-resync:
+				e.update("")
+				debounced(refresh)
 			case err := <-errs:
 				if errors.Is(err, context.Canceled) {
 					return
 				}
 
-				u.logger.Warn("unable to monitor container events; will retry", zap.Error(err))
+				if errors.Is(err, io.EOF) {
+					u.logger.Info("event stream is closed by the daemon; will reconnect",
+						zap.String("endpoint", e.name),
+					)
+					break selectLoop
+				}
+
+				if errdefs.IsForbidden(err) {
+					u.logger.Warn("event stream is forbidden; polling instead",
+						zap.String("endpoint", e.name),
+						zap.Error(err),
+					)
+					u.pollDocker(ctx, e)
+					return
+				}
+
+				metrics.apiErrors.WithLabelValues(e.name).Inc()
+				u.logger.Warn("unable to monitor container events; will retry",
+					zap.String("endpoint", e.name),
+					zap.Error(err),
+				)
 				break selectLoop
 			}
 		}
 
-		select {
-		case <-ctx.Done():
+		if !u.waitDaemon(ctx, e) {
 			return
-		case <-time.After(500 * time.Millisecond):
 		}
+		reconnected = true
 	}
 }
 
 func (u *Upstreams) Provision(ctx caddy.Context) error {
+	u.ctx = ctx
 	u.logger = ctx.Logger()
+	u.startups = make(map[string]*startup)
+	u.noIPs = make(map[string]time.Time)
+	u.invalid = make(map[string]struct{})
+	u.replaced = make(map[composeKey]time.Time)
+	u.instance = getInstance(u.Instance)
+	u.selfID, _ = selfContainerID()
+	u.globs = excludeGlobs{
+		includeName:  compileGlobs(u.IncludeName),
+		includeImage: compileGlobs(u.IncludeImage),
+		excludeName:  compileGlobs(u.ExcludeName),
+		excludeImage: compileGlobs(u.ExcludeImage),
+	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return err
+	if u.Debounce == 0 {
+		u.Debounce = caddy.Duration(defaultDebounce)
+	}
+	if u.ReconnectMaxDelay == 0 {
+		u.ReconnectMaxDelay = caddy.Duration(defaultReconnectMaxDelay)
+	}
+	if u.APITimeout == 0 {
+		u.APITimeout = caddy.Duration(defaultAPITimeout)
+	}
+	if u.ProbeFailures == 0 {
+		u.ProbeFailures = defaultProbeFailures
+	}
+	if u.CrashLoopBackoff == 0 {
+		u.CrashLoopBackoff = caddy.Duration(defaultCrashLoopBackoff)
+	}
+	if u.Fallback != "" {
+		u.fallback = &reverseproxy.Upstream{Dial: u.Fallback}
+	}
+	if u.Webhook != "" {
+		u.webhook = &webhook{notify: make(chan struct{}, 1)}
+	}
+	if u.EmitEvents {
+		app, err := ctx.App("events")
+		if err != nil {
+			return fmt.Errorf("getting events app: %w", err)
+		}
+		u.events = app.(*caddyevents.App)
 	}
 
-	ping, err := cli.Ping(ctx)
-	if err != nil {
-		return err
+	if u.Instance != "" && u.LabelPrefix == "" {
+		u.LabelPrefix = defaultLabelPrefix + "." + u.Instance
+	}
+	u.LabelPrefix = strings.TrimSuffix(u.LabelPrefix, ".")
+	if u.LabelPrefix == defaultLabelPrefix {
+		u.LabelPrefix = ""
 	}
 
-	u.logger.Info("docker engine is connected", zap.String("api_version", ping.APIVersion))
+	if _, ok := builtinProviders[u.Provider]; !ok && u.Provider != "" && u.Provider != ProviderDocker && u.Provider != ProviderPodman {
+		return fmt.Errorf("unrecognized provider '%s'", u.Provider)
+	}
 
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
-		Filters: filters.NewArgs(filters.Arg("label", LabelEnable)),
-	})
-	if err != nil {
-		return err
+	switch u.Mode {
+	case "", ModeContainer, ModeSwarm, ModePoll:
+	default:
+		return fmt.Errorf("unrecognized mode '%s'", u.Mode)
+	}
+
+	switch u.IPVersion {
+	case "", IPVersionPreferIPv4, IPVersionPreferIPv6, IPVersionIPv4Only, IPVersionIPv6Only:
+	default:
+		return fmt.Errorf("unrecognized ip_version '%s'", u.IPVersion)
+	}
+
+	for _, api := range u.DisableAPI {
+		if api != APIPing && api != APIEvents {
+			return fmt.Errorf("unrecognized disable_api '%s'", api)
+		}
+	}
+
+	switch u.StalePolicy {
+	case "", StalePolicyServe, StalePolicyFail:
+	default:
+		return fmt.Errorf("unrecognized stale_policy '%s'", u.StalePolicy)
+	}
+
+	switch u.DialName {
+	case "", DialNameContainer, DialNameService:
+	default:
+		return fmt.Errorf("unrecognized dial_name '%s'", u.DialName)
+	}
+
+	switch u.SwarmDial {
+	case "", SwarmDialTasks, SwarmDialVIP:
+	default:
+		return fmt.Errorf("unrecognized swarm_dial '%s'", u.SwarmDial)
 	}
 
-	u.provisionCandidates(ctx, containers)
+	if u.AddressTemplate != "" {
+		err := checkAddressTemplate(u.AddressTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid address_template '%s': %w", u.AddressTemplate, err)
+		}
+	}
 
-	go u.keepUpdated(ctx, cli)
+	if u.Provider == ProviderPodman && u.Mode == ModeSwarm {
+		return errors.New("swarm mode is not supported by podman")
+	}
+	if u.Provider != "" && u.Provider != ProviderDocker && u.Mode == ModeSwarm {
+		return fmt.Errorf("swarm mode is not supported by %s", u.Provider)
+	}
+	if u.Provider != "" && u.Provider != ProviderDocker && u.Provider != ProviderPodman && u.Mode == ModePoll {
+		return fmt.Errorf("poll mode is not supported by %s", u.Provider)
+	}
+
+	configs := u.Endpoints
+	if len(configs) == 0 {
+		configs = []Endpoint{{
+			Host:       u.Host,
+			APIVersion: u.APIVersion,
+			CertPath:   u.CertPath,
+			TLSVerify:  u.TLSVerify,
+			TLSCA:      u.TLSCA,
+			TLSCert:    u.TLSCert,
+			TLSKey:     u.TLSKey,
+		}}
+	}
+
+	// The built-in provider is not connected to if only third-party
+	// providers are configured.
+	if len(u.ProvidersRaw) > 0 && u.Provider == "" && u.Host == "" && len(u.Endpoints) == 0 {
+		configs = nil
+	}
+
+	u.endpoints = make([]*endpoint, 0, len(configs)+len(u.ProvidersRaw))
+	for i, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = fmt.Sprintf("endpoint%d", i)
+		}
+
+		if _, ok := builtinProviders[u.Provider]; ok {
+			e, err := u.newEndpoint(ctx, name, config)
+			if err != nil {
+				return err
+			}
+			u.endpoints = append(u.endpoints, e)
+			continue
+		}
+
+		cli, err := u.newClient(config)
+		if err != nil {
+			return err
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, time.Duration(u.APITimeout))
+		ping, err := pingDocker(pingCtx, cli, u.disabledAPI(APIPing))
+		cancel()
+		switch {
+		case err != nil && u.LazyConnect:
+			u.logger.Warn("unable to connect to docker engine; will retry",
+				zap.String("endpoint", name),
+				zap.String("host", cli.DaemonHost()),
+				zap.Error(err),
+			)
+		case err != nil:
+			return fmt.Errorf("unable to connect to endpoint '%s': %w", name, err)
+		default:
+			u.logger.Info("docker engine is connected",
+				zap.String("endpoint", name),
+				zap.String("host", cli.DaemonHost()),
+				zap.String("api_version", ping.APIVersion),
+			)
+		}
+
+		u.endpoints = append(u.endpoints, &endpoint{
+			name:       name,
+			host:       endpointHost(config),
+			cli:        cli,
+			apiTimeout: time.Duration(u.APITimeout),
+			limiter:    u.newLimiter(),
+			noPing:     u.disabledAPI(APIPing),
+			noEvents:   u.Mode == ModePoll || u.disabledAPI(APIEvents),
+			wakeup:     make(chan struct{}, 1),
+		})
+	}
+
+	if len(u.ProvidersRaw) > 0 {
+		mods, err := ctx.LoadModule(u, "ProvidersRaw")
+		if err != nil {
+			return fmt.Errorf("loading providers: %w", err)
+		}
+		for i, mod := range mods.([]any) {
+			provider, ok := mod.(Provider)
+			if !ok {
+				return fmt.Errorf("module %T is not a Provider", mod)
+			}
+			u.endpoints = append(u.endpoints, &endpoint{
+				name:     fmt.Sprintf("%s%d", caddy.GetModuleName(mod), i),
+				provider: provider,
+				wakeup:   make(chan struct{}, 1),
+			})
+		}
+	}
+
+	for _, e := range u.endpoints {
+		err := u.refresh(ctx, e)
+		if err != nil && !u.LazyConnect {
+			return err
+		}
+		if err != nil {
+			metrics.apiErrors.WithLabelValues(e.name).Inc()
+			// The watch lists the upstreams again once connected.
+			u.logger.Warn("unable to list upstreams; will retry",
+				zap.String("endpoint", e.name),
+				zap.Error(err),
+			)
+		}
+
+		switch {
+		case e.provider != nil:
+			go u.watchProvider(ctx, e)
+		default:
+			go u.keepUpdated(ctx, e)
+		}
+	}
+
+	// The probes and health checks are shared by the modules of the
+	// instance.
+	u.instance.acquire(u)
+	u.acquired = true
+	if u.webhook != nil {
+		go u.postWebhook(ctx)
+	}
 
 	return nil
 }
 
 func (u *Upstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
-	upstreams := make([]*reverseproxy.Upstream, 0, 1)
+	matched := make([]candidate, 0, 1)
+
+	s := u.instance.loadSnapshot()
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var fallbacks []candidate
+	for _, i := range s.hosts.lookup(r) {
+		container := s.candidates[i]
+		if !container.matchers.AnyMatch(r) || container.mirror {
+			continue
+		}
+		if u.ProbeInterval > 0 && u.instance.isQuarantined(container.address) {
+			continue
+		}
+		if u.instance.isUnhealthy(container.address) {
+			continue
+		}
+		if !groupActive(s.groups, container.deployGroup) {
+			continue
+		}
+		if u.StalePolicy == StalePolicyFail && u.MaxStaleness > 0 && isStale(container, time.Duration(u.MaxStaleness)) {
+			continue
+		}
 
-	candidatesMu.RLock()
-	defer candidatesMu.RUnlock()
+		if container.placeholder != "" && repl != nil {
+			repl.Set(container.placeholder, container.address)
+		}
 
-	for _, container := range candidates {
-		if !container.matchers.Match(r) {
+		if container.fallback {
+			fallbacks = append(fallbacks, container)
 			continue
 		}
+		matched = append(matched, container)
+	}
+
+	switch {
+	case len(matched) > 0:
+		metrics.upstreamsCount.WithLabelValues("match").Inc()
+	case len(fallbacks) > 0:
+		metrics.upstreamsCount.WithLabelValues("fallback").Inc()
+		matched = fallbacks
+	case u.fallback != nil:
+		metrics.upstreamsCount.WithLabelValues("fallback").Inc()
+		return []*reverseproxy.Upstream{u.fallback}, nil
+	default:
+		metrics.upstreamsCount.WithLabelValues("no_match").Inc()
+	}
+
+	matched = orderByPolicy(byPriority(matched), r)
 
-		upstreams = append(upstreams, container.upstream)
+	if len(matched) == 1 && repl != nil {
+		matched[0].setPlaceholders(repl)
+	}
+
+	upstreams := make([]*reverseproxy.Upstream, 0, len(matched))
+	for _, container := range matched {
+		upstreams = container.appendUpstream(upstreams)
 	}
 
 	return upstreams, nil
 }
 
+// Cleanup releases the probes and health checks of the instance.
+func (u *Upstreams) Cleanup() error {
+	if u.acquired {
+		u.instance.release()
+		u.acquired = false
+	}
+	return nil
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Upstreams)(nil)
+	_ caddy.CleanerUpper          = (*Upstreams)(nil)
+	_ caddy.Validator             = (*Upstreams)(nil)
 	_ reverseproxy.UpstreamSource = (*Upstreams)(nil)
 )
@@ -0,0 +1,95 @@
+package caddy_docker_upstreams
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types/events"
+)
+
+// TestReuseProvisionedUpstream proxies a request with the passive health
+// checks, whose unhealthy_request_count sets MaxRequests of the upstream, and
+// checks the upstream is reused by the next refresh.
+func TestReuseProvisionedUpstream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer backend.Close()
+	backendHost, backendPort, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+
+	web := fakeContainer("web", backendHost, map[string]string{LabelUpstreamPort: backendPort})
+	d := newFakeDaemon(t, web)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := ln.Addr().String()
+	ln.Close()
+
+	const name = "test-reuse-provisioned"
+	config, _ := json.Marshal(map[string]any{
+		"admin": map[string]any{"disabled": true, "config": map[string]any{"persist": false}},
+		"apps": map[string]any{"http": map[string]any{"servers": map[string]any{"proxy": map[string]any{
+			"listen":          []string{listen},
+			"automatic_https": map[string]any{"disable": true},
+			"routes": []any{map[string]any{"handle": []any{map[string]any{
+				"handler": "reverse_proxy",
+				"dynamic_upstreams": map[string]any{
+					"source":       "docker",
+					"host":         "tcp://" + strings.TrimPrefix(d.srv.URL, "http://"),
+					"api_version":  "1.41",
+					"instance":     name,
+					"label_prefix": defaultLabelPrefix,
+				},
+				"health_checks": map[string]any{"passive": map[string]any{
+					"fail_duration":           "10s",
+					"max_fails":               1,
+					"unhealthy_request_count": 5,
+				}},
+			}}}},
+		}}}},
+	})
+	if err := caddy.Load(config, true); err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+	defer func() {
+		_ = caddy.Stop()
+		instancesMu.Lock()
+		delete(instances, name)
+		instancesMu.Unlock()
+	}()
+
+	resp, err := http.Get("http://" + listen + "/")
+	if err != nil {
+		t.Fatalf("unable to proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	i := getInstance(name)
+	proxied := i.loadSnapshot()
+	if got := proxied.candidates[0].upstream.MaxRequests; got != 5 {
+		t.Fatalf("max requests = %d, want the unhealthy_request_count set by the proxy", got)
+	}
+
+	// The event of the container rebuilds the candidates.
+	d.send(events.Message{Type: events.ContainerEventType, Action: "start", Actor: events.Actor{ID: web.ID}})
+	deadline := time.Now().Add(5 * time.Second)
+	for i.loadSnapshot() == proxied {
+		if time.Now().After(deadline) {
+			t.Fatal("candidates are not rebuilt")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := i.loadSnapshot().candidates[0].upstream; got != proxied.candidates[0].upstream {
+		t.Errorf("upstream %p is not reused after the refresh, got %p", proxied.candidates[0].upstream, got)
+	}
+}
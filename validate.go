@@ -0,0 +1,232 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// labeledObject is an object listed from an endpoint, e.g. a container,
+// whose labels configure upstreams.
+type labeledObject struct {
+	kind   string
+	name   string
+	labels map[string]string
+	// ports are the named ports of the object, valid values of the port
+	// labels.
+	ports map[string]int
+}
+
+// labeledObjects returns the enabled objects last listed from the endpoint.
+func (u *Upstreams) labeledObjects(e *endpoint) []labeledObject {
+	var objects []labeledObject
+	add := func(kind, name string, labels map[string]string) {
+		if labels[LabelEnable] == "true" {
+			objects = append(objects, labeledObject{kind: kind, name: name, labels: labels})
+		}
+	}
+
+	switch {
+	case e.provider != nil:
+		// The targets of an object are checked once.
+		seen := make(map[string]struct{}, len(e.targets))
+		for _, target := range e.targets {
+			kind, name := target.Kind, target.Object
+			if kind == "" {
+				kind = "target"
+			}
+			if name == "" {
+				name = target.Name
+			}
+			key := kind + "/" + name
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if target.Labels[LabelEnable] == "true" {
+				objects = append(objects, labeledObject{kind: kind, name: name, labels: target.Labels, ports: target.Ports})
+			}
+		}
+	case u.Mode == ModeSwarm:
+		for _, service := range e.services {
+			add("service", service.Spec.Name, service.Spec.Labels)
+		}
+	default:
+		for _, container := range e.containers {
+			if u.isSelf(container.ID) || u.excluded(container) {
+				continue
+			}
+			add("container", containerName(container), container.Labels)
+		}
+	}
+
+	return objects
+}
+
+// Validate reports the invalid labels of the objects listed when the module
+// was provisioned with StrictLabels, they are only logged when building
+// upstreams otherwise.
+func (u *Upstreams) Validate() error {
+	if !u.StrictLabels {
+		return nil
+	}
+	return u.labelErrors()
+}
+
+// labelErrors returns the invalid labels of the objects listed from the
+// endpoints.
+func (u *Upstreams) labelErrors() error {
+	var errs []error
+	for _, e := range u.endpoints {
+		for _, object := range u.labeledObjects(e) {
+			for _, err := range u.checkLabels(object.labels, object.ports) {
+				errs = append(errs, fmt.Errorf("%s '%s': %w", object.kind, object.name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid labels: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// LabelError is an invalid label value.
+type LabelError struct {
+	// Label is the label key, with the default prefix.
+	Label string
+	Value string
+	// Upstream is the named upstream of the label, if any.
+	Upstream string
+	Err      error
+}
+
+func (e *LabelError) Error() string {
+	if e.Upstream != "" {
+		return fmt.Sprintf("%s: upstream '%s': %v", e.Label, e.Upstream, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Label, e.Err)
+}
+
+func (e *LabelError) Unwrap() error {
+	return e.Err
+}
+
+// ParseLabels validates the values of the labels of a container, with the
+// default prefix, like the module does when the config is loaded. The error
+// joins a *LabelError per invalid label.
+func ParseLabels(labels map[string]string) error {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	u := &Upstreams{ctx: ctx}
+	return errors.Join(u.checkLabels(labels, nil)...)
+}
+
+// checkLabels returns the errors of the label values, the values having
+// placeholders are only known when building upstreams and aren't checked.
+// The port labels may name one of ports.
+func (u *Upstreams) checkLabels(labels map[string]string, ports map[string]int) []error {
+	var errs []error
+	checked := make(map[string]struct{})
+
+	for _, named := range namedUpstreams(labels) {
+		labels := named.labels
+		check := func(key string, err error) {
+			if err == nil {
+				return
+			}
+			// The named upstreams share the labels of the container.
+			labelErr := &LabelError{Label: key, Value: labels[key], Upstream: named.name, Err: err}
+			if _, ok := checked[labelErr.Error()]; !ok {
+				checked[labelErr.Error()] = struct{}{}
+				errs = append(errs, labelErr)
+			}
+		}
+
+		for _, key := range sortedKeys(labels) {
+			value := labels[key]
+			if strings.Contains(value, "{") {
+				continue
+			}
+
+			switch key {
+			case LabelUpstreamPort:
+				if _, ok := ports[value]; !ok {
+					check(key, checkPort(value))
+				}
+			case LabelUpstreamWeight, LabelUpstreamMaxRequests:
+				if n, err := strconv.Atoi(value); err != nil || n < 1 {
+					check(key, fmt.Errorf("invalid positive integer '%s'", value))
+				}
+			case LabelUpstreamPriority:
+				if _, err := strconv.Atoi(value); err != nil {
+					check(key, fmt.Errorf("invalid integer '%s'", value))
+				}
+			case LabelEnable, LabelHealthCheck, LabelFallback, LabelUpstreamPublished,
+				LabelUpstreamGroupActive, LabelUpstreamTLSInsecureSkipVerify, LabelHealthCheckGRPC, LabelMirror:
+				if value != "true" && value != "false" {
+					check(key, fmt.Errorf("invalid boolean '%s', expected true or false", value))
+				}
+			case LabelUpstreamScheme:
+				if value != "http" && value != "https" {
+					check(key, fmt.Errorf("unrecognized scheme '%s'", value))
+				}
+			case LabelUpstreamProtocol:
+				if value != ProtocolHTTP && value != ProtocolH2C && value != ProtocolFastCGI {
+					check(key, fmt.Errorf("unrecognized protocol '%s'", value))
+				}
+			case LabelHealthCheckInterval, LabelHealthCheckTimeout:
+				if d, err := caddy.ParseDuration(value); err != nil || d <= 0 {
+					check(key, fmt.Errorf("invalid positive duration '%s'", value))
+				}
+			case LabelHealthCheckExpectedStatus:
+				check(key, checkExpectedStatus(value))
+			case LabelUpstreamSwarmDial:
+				if value != SwarmDialTasks && value != SwarmDialVIP {
+					check(key, fmt.Errorf("unrecognized swarm dial '%s'", value))
+				}
+			case LabelCanaryHeader:
+				_, _, err := parseCanaryHeader(value)
+				check(key, err)
+			case LabelLBPolicy:
+				_, err := parsePolicy(value)
+				check(key, err)
+			default:
+				matcher, ok, err := produceMatcher(key, value)
+				if !ok {
+					continue
+				}
+				if err == nil {
+					if prov, ok := matcher.(caddy.Provisioner); ok {
+						err = prov.Provision(u.ctx)
+					}
+				}
+				check(key, err)
+			}
+		}
+	}
+
+	return errs
+}
+
+func checkPort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port '%s'", value)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,79 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types"
+)
+
+func TestValidateStrictLabels(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	e := &endpoint{containers: []types.Container{{
+		ID:     "bad",
+		Names:  []string{"/bad"},
+		Labels: map[string]string{LabelEnable: "true", LabelUpstreamPort: "http"},
+	}}}
+
+	u := &Upstreams{ctx: ctx, endpoints: []*endpoint{e}}
+	if err := u.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want the invalid labels only logged", err)
+	}
+
+	u.StrictLabels = true
+	if err := u.Validate(); err == nil {
+		t.Error("Validate() = nil with strict_labels, want the invalid port")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	valid := map[string]string{
+		LabelEnable:         "true",
+		LabelUpstreamPort:   "8080",
+		LabelUpstreamWeight: "2",
+		LabelMatchHost:      "a.example.com",
+		LabelMatchPath:      "/api/*",
+		// The placeholders are only known when building upstreams.
+		labelUpstreamPrefix + "metrics.port": "{container.port}",
+	}
+	if err := ParseLabels(valid); err != nil {
+		t.Errorf("ParseLabels() = %v, want nil", err)
+	}
+
+	invalid := map[string]string{
+		LabelEnable:          "yes",
+		LabelUpstreamPort:    "70000",
+		LabelMatchExpression: "host(",
+		LabelMatchHost:       "a.example.com",
+	}
+	err := ParseLabels(invalid)
+	if err == nil {
+		t.Fatal("ParseLabels() = nil, want the invalid labels")
+	}
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("ParseLabels() = %T, want joined errors", err)
+	}
+	got := make(map[string]string)
+	for _, err := range joined.Unwrap() {
+		var labelErr *LabelError
+		if !errors.As(err, &labelErr) {
+			t.Fatalf("error %v is not a *LabelError", err)
+		}
+		got[labelErr.Label] = labelErr.Value
+	}
+	want := map[string]string{
+		LabelEnable:          "yes",
+		LabelUpstreamPort:    "70000",
+		LabelMatchExpression: "host(",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid labels = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package caddy_docker_upstreams
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// webhook posts the upstreams to the Webhook URL when they change. Only the
+// latest upstreams are posted if they change again while posting.
+type webhook struct {
+	mu      sync.Mutex
+	pending []byte
+	notify  chan struct{}
+}
+
+// changed reports whether the candidates are different upstreams than the
+// previous ones.
+func changed(previous, updated []candidate) bool {
+	added, removed := diffCandidates(previous, updated)
+	return len(added) > 0 || len(removed) > 0
+}
+
+// queue replaces the upstreams waiting to be posted.
+func (h *webhook) queue(refreshed time.Time, updated []candidate) error {
+	body, err := json.Marshal(newAdminUpstreams(refreshed, updated))
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.pending = body
+	h.mu.Unlock()
+
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// postWebhook posts the queued upstreams until ctx is done.
+func (u *Upstreams) postWebhook(ctx context.Context) {
+	client := &http.Client{Timeout: webhookTimeout}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.webhook.notify:
+		}
+
+		u.webhook.mu.Lock()
+		body := u.webhook.pending
+		u.webhook.pending = nil
+		u.webhook.mu.Unlock()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.Webhook, bytes.NewReader(body))
+		if err != nil {
+			u.logger.Error("unable to create webhook request", zap.Error(err))
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				u.logger.Error("unable to post upstreams to webhook",
+					zap.String("url", u.Webhook),
+					zap.Error(err),
+				)
+			}
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			u.logger.Warn("webhook responded with an error status",
+				zap.String("url", u.Webhook),
+				zap.Int("status", resp.StatusCode),
+			)
+		}
+	}
+}